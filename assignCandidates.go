@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The most combinations we'll try for one group of conflicting candidates.  If we run out we use the best we've
+// found so far, which is never worse than taking them greedily.
+const ASSIGN_BUDGET = 100000
+
+// Normally we take the first result we find for each spine.  But that depends on which search came back first,
+// and a worse match can claim words that a better one needed.  Instead we can look at all the candidates together
+// and choose the set with the highest total confidence, where no two identify the same spine or use the same words.
+type claim struct {
+	result searchResult
+	score  int
+	words  map[string]bool
+}
+
+func (a *claim) conflicts(b *claim) bool {
+	if a.result.spineindex == b.result.spineindex {
+		return true
+	}
+
+	for word := range a.words {
+		if b.words[word] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The words on the spines which a result was found from.
+func claimedWords(spines []Spine, result searchResult) map[string]bool {
+	words := map[string]bool{}
+	searched := map[string]bool{}
+
+	for _, word := range strings.Fields(strings.ToLower(result.searchAuthor + " " + result.searchTitle)) {
+		searched[word] = true
+	}
+
+	for spineindex := result.firstspine; spineindex <= result.spineindex && spineindex < len(spines); spineindex++ {
+		for wordindex, word := range strings.Fields(strings.ToLower(spines[spineindex].Spine)) {
+			if searched[word] {
+				words[fmt.Sprintf("%d:%d", spineindex, wordindex)] = true
+			}
+		}
+	}
+
+	return words
+}
+
+func assignCandidates(spines []Spine, candidates map[int][]searchResult, p phase) []searchResult {
+	claims := []*claim{}
+	spineindexes := []int{}
+
+	for spineindex := range candidates {
+		spineindexes = append(spineindexes, spineindex)
+	}
+
+	// Map order is random, and we want the same answer every time.
+	sort.Ints(spineindexes)
+
+	for _, spineindex := range spineindexes {
+		for _, result := range candidates[spineindex] {
+			claims = append(claims, &claim{
+				result: result,
+				score:  result.confidence(p),
+				words:  claimedWords(spines, result),
+			})
+		}
+	}
+
+	sort.SliceStable(claims, func(a, b int) bool {
+		return claims[a].score > claims[b].score
+	})
+
+	// Claims which can't conflict can be decided separately, which keeps the search small.
+	results := []searchResult{}
+
+	for _, group := range conflictGroups(claims) {
+		for _, c := range bestAssignment(group) {
+			sugar.Debugf("Assign %s - %s to spine %d score %d", c.result.foundAuthor, c.result.foundTitle, c.result.spineindex, c.score)
+			results = append(results, c.result)
+		}
+	}
+
+	return results
+}
+
+// Split the claims into groups where no claim conflicts with one in another group.  Order within a group is kept.
+func conflictGroups(claims []*claim) [][]*claim {
+	parent := make([]int, len(claims))
+
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+
+		return parent[i]
+	}
+
+	for a := 0; a < len(claims); a++ {
+		for b := a + 1; b < len(claims); b++ {
+			if claims[a].conflicts(claims[b]) {
+				parent[find(a)] = find(b)
+			}
+		}
+	}
+
+	groups := [][]*claim{}
+	index := map[int]int{}
+
+	for i, c := range claims {
+		root := find(i)
+
+		if _, ok := index[root]; !ok {
+			index[root] = len(groups)
+			groups = append(groups, []*claim{})
+		}
+
+		groups[index[root]] = append(groups[index[root]], c)
+	}
+
+	return groups
+}
+
+// The claims with the highest total score which don't conflict.  The claims must be best first.
+func bestAssignment(claims []*claim) []*claim {
+	// Start with the greedy answer, so that we have something good to beat.
+	best := []*claim{}
+	bestscore := 0
+
+	for _, c := range claims {
+		if !conflictsWithAny(c, best) {
+			best = append(best, c)
+			bestscore += c.score
+		}
+	}
+
+	// The most the claims from each point on could add, if none of them conflicted.
+	remaining := make([]int, len(claims)+1)
+
+	for i := len(claims) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + claims[i].score
+	}
+
+	budget := ASSIGN_BUDGET
+	chosen := []*claim{}
+
+	var search func(int, int)
+	search = func(i int, score int) {
+		budget--
+
+		if score > bestscore {
+			best = append([]*claim{}, chosen...)
+			bestscore = score
+		}
+
+		if i >= len(claims) || budget <= 0 || score+remaining[i] <= bestscore {
+			return
+		}
+
+		if !conflictsWithAny(claims[i], chosen) {
+			chosen = append(chosen, claims[i])
+			search(i+1, score+claims[i].score)
+			chosen = chosen[0 : len(chosen)-1]
+		}
+
+		search(i+1, score)
+	}
+
+	search(0, 0)
+
+	if budget <= 0 {
+		sugar.Infof("Ran out of budget assigning %d candidates", len(claims))
+	}
+
+	return best
+}
+
+func conflictsWithAny(c *claim, claims []*claim) bool {
+	for _, other := range claims {
+		if c.conflicts(other) {
+			return true
+		}
+	}
+
+	return false
+}
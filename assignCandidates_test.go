@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAssignCandidates(t *testing.T) {
+	spines := []Spine{
+		{Spine: "EDWARD MARSTON DANCE OF"},
+		{Spine: "DEATH HENNING MANKELL FIFTH WOMAN"},
+	}
+
+	// A title running across both spines, which would stop either of the others being used.
+	across := searchResult{
+		spineindex:   1,
+		firstspine:   0,
+		searchAuthor: "Edward Marston",
+		searchTitle:  "Dance of Death",
+		foundAuthor:  "Edward Marston",
+		foundTitle:   "Dance of Death",
+		authorScore:  100,
+		titleScore:   100,
+	}
+
+	first := searchResult{
+		spineindex:   0,
+		firstspine:   0,
+		searchAuthor: "EDWARD MARSTON",
+		searchTitle:  "DANCE OF",
+		foundAuthor:  "Edward Marston",
+		foundTitle:   "Dance On",
+		authorScore:  100,
+		titleScore:   CONFIDENCE,
+	}
+
+	second := searchResult{
+		spineindex:   1,
+		firstspine:   1,
+		searchAuthor: "HENNING MANKELL",
+		searchTitle:  "FIFTH WOMAN",
+		foundAuthor:  "Henning Mankell",
+		foundTitle:   "The Fifth Woman",
+		authorScore:  100,
+		titleScore:   100,
+	}
+
+	// Greedily we'd take the best single one, but the other two together are better.
+	results := assignCandidates(spines, map[int][]searchResult{
+		0: {first},
+		1: {across, second},
+	}, phase{})
+
+	titles := []string{}
+
+	for _, result := range results {
+		titles = append(titles, result.foundTitle)
+	}
+
+	assert.ElementsMatch(t, []string{"Dance On", "The Fifth Woman"}, titles)
+
+	// Two for the same spine - the better one wins.
+	worse := second
+	worse.titleScore = CONFIDENCE
+	worse.foundTitle = "Fifth Women"
+	results = assignCandidates(spines, map[int][]searchResult{
+		1: {worse, second},
+	}, phase{})
+
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "The Fifth Woman", results[0].foundTitle)
+}
+
+func TestGlobalIdentifier(t *testing.T) {
+	identifier := NewIdentifier(&stubCatalogue{
+		works: []Work{
+			{Author: "Edward Marston", Title: "Dances of Death", NormalAuthor: "edward marston", NormalTitle: "dances death", VIAF: "12345"},
+			{Author: "Edward Marston", Title: "Dance of Death", NormalAuthor: "edward marston", NormalTitle: "dance death", VIAF: "12345"},
+		},
+	})
+	identifier.Global = true
+
+	spines, _, err := identifier.IdentifyBooks(context.Background(), []Spine{{Spine: "EDWARD MARSTON DANCE OF DEATH"}}, []OCRFragment{})
+	assert.Nil(t, err)
+
+	// Whichever we happen to find first, we pick the better.
+	assert.Equal(t, "Dance of Death", spines[0].Title)
+}
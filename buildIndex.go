@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The mapping for our index.  The normalised fields are keywords because we fuzzy match against the whole value.
+var indexMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"author":       map[string]interface{}{"type": "text"},
+			"title":        map[string]interface{}{"type": "text"},
+			"normalauthor": map[string]interface{}{"type": "keyword"},
+			"normaltitle":  map[string]interface{}{"type": "keyword"},
+			"viafid":       map[string]interface{}{"type": "keyword"},
+			"olid":         map[string]interface{}{"type": "keyword"},
+			"popularity":   map[string]interface{}{"type": "integer"},
+		},
+	},
+}
+
+func indexCommand(args []string) error {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	dumpPtr := flags.String("f", "", "Dump file to load (may be gzipped)")
+	formatPtr := flags.String("format", "viaf", "Dump format: viaf, openlibrary, jsonl or csv")
+	authorsPtr := flags.String("authors", "", "Open Library authors dump, needed for the openlibrary format")
+	editionsPtr := flags.String("editions", "", "Open Library editions dump, to count editions for popularity")
+	batchPtr := flags.Int("batch", 1000, "Documents per bulk request")
+	recreatePtr := flags.Bool("recreate", false, "Delete the index first if it exists")
+	dictionaryPtr := flags.String("dictionary", "", "Write the words in the works, with their counts, to this file")
+	esFlags := addElasticFlags(flags)
+	flags.Parse(args)
+
+	cfg, err := esFlags.resolve()
+
+	if err != nil {
+		return err
+	}
+
+	if len(*dumpPtr) == 0 {
+		return errors.New("no dump file given")
+	}
+
+	dump, err := openDump(*dumpPtr)
+
+	if err != nil {
+		return err
+	}
+
+	defer dump.Close()
+
+	var authors io.ReadCloser
+
+	if *formatPtr == "openlibrary" {
+		if len(*authorsPtr) == 0 {
+			return errors.New("the openlibrary format needs an authors dump")
+		}
+
+		authors, err = openDump(*authorsPtr)
+
+		if err != nil {
+			return err
+		}
+
+		defer authors.Close()
+	}
+
+	var editions io.ReadCloser
+
+	if *formatPtr == "openlibrary" && len(*editionsPtr) > 0 {
+		editions, err = openDump(*editionsPtr)
+
+		if err != nil {
+			return err
+		}
+
+		defer editions.Close()
+	}
+
+	es, err := newElasticClient(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	if err := createIndex(es, cfg.Index, *recreatePtr); err != nil {
+		return err
+	}
+
+	dict := newDictionary()
+	loader := &bulkLoader{
+		es:    es,
+		index: cfg.Index,
+		batch: *batchPtr,
+	}
+
+	err = readDump(dump, *formatPtr, authors, editions, func(work Work) error {
+		// Always use our own normalisation, so that the index and the queries can't disagree.
+		work.NormalAuthor = NormalizeAuthor(work.Author)
+		work.NormalTitle = NormalizeTitle(work.Title)
+
+		if len(work.NormalAuthor) == 0 || len(work.NormalTitle) == 0 {
+			return nil
+		}
+
+		dict.add(work)
+
+		return loader.add(work)
+	})
+
+	if err == nil {
+		err = loader.flush()
+	}
+
+	if err == nil {
+		// Anything which cached searches against the old contents needs to know they've changed.
+		err = markLoaded(es, cfg.Index)
+	}
+
+	sugar.Infof("Indexed %d works into %s", loader.count, cfg.Index)
+
+	if err == nil && len(*dictionaryPtr) > 0 {
+		err = writeDictionary(*dictionaryPtr, dict)
+	}
+
+	return err
+}
+
+func writeDictionary(filename string, dict *dictionary) error {
+	f, err := os.Create(filename)
+
+	if err != nil {
+		return err
+	}
+
+	if err = dict.write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	sugar.Infof("Wrote %d words to %s", len(dict.words), filename)
+
+	return f.Close()
+}
+
+func openDump(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// The editions dump is optional.
+func readDump(r io.Reader, format string, authors io.Reader, editions io.Reader, fn func(Work) error) error {
+	switch format {
+	case "viaf":
+		return readVIAF(r, fn)
+	case "openlibrary":
+		names, err := readOpenLibraryAuthors(authors)
+
+		if err != nil {
+			return err
+		}
+
+		counts := map[string]int{}
+
+		if editions != nil {
+			if counts, err = readOpenLibraryEditions(editions); err != nil {
+				return err
+			}
+		}
+
+		return readOpenLibraryWorks(r, names, counts, fn)
+	default:
+		return readWorks(r, format, fn)
+	}
+}
+
+// Each line of the VIAF clusters dump is an id, a tab, and then the XML for that cluster.
+type viafCluster struct {
+	ID       string     `xml:"viafID"`
+	NameType string     `xml:"nameType"`
+	Headings []string   `xml:"mainHeadings>data>text"`
+	Works    []viafWork `xml:"titles>work"`
+}
+
+// The sources are the national libraries which hold the work, which makes a decent measure of popularity.
+type viafWork struct {
+	Title   string   `xml:"title"`
+	Sources []string `xml:"sources>s"`
+}
+
+var viafDates = regexp.MustCompile(`\d`)
+
+// VIAF headings are "Surname, Forenames, dates".  Spines are "Forenames Surname".
+func viafAuthor(heading string) string {
+	parts := []string{}
+
+	for _, part := range strings.Split(heading, ",") {
+		part = strings.TrimSpace(part)
+
+		if len(part) > 0 && !viafDates.MatchString(part) {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) >= 2 {
+		parts[0], parts[1] = parts[1], parts[0]
+		parts = parts[0:2]
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func readVIAF(r io.Reader, fn func(Work) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+
+		if tab := strings.IndexByte(text, '\t'); tab >= 0 {
+			text = text[tab+1:]
+		}
+
+		var cluster viafCluster
+
+		if err := xml.Unmarshal([]byte(text), &cluster); err != nil {
+			sugar.Warnf("Skip VIAF line %d: %s", line, err)
+			continue
+		}
+
+		if cluster.NameType != "Personal" || len(cluster.Headings) == 0 {
+			continue
+		}
+
+		author := viafAuthor(cluster.Headings[0])
+
+		for _, work := range cluster.Works {
+			err := fn(Work{
+				Author:     author,
+				Title:      strings.TrimSpace(work.Title),
+				VIAF:       cluster.ID,
+				Popularity: len(work.Sources),
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Open Library dumps are tab separated, with the record as JSON in the last column.
+func openLibraryRecords(r io.Reader, fn func(record map[string]interface{}) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		text := scanner.Text()
+
+		if tab := strings.LastIndexByte(text, '\t'); tab >= 0 {
+			text = text[tab+1:]
+		}
+
+		var record map[string]interface{}
+
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			continue
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Works refer to their authors by key, so we need the names first.  We keep the author's VIAF id if Open Library knows
+// it, and the Open Library key in any case.
+func readOpenLibraryAuthors(r io.Reader) (map[string]Work, error) {
+	authors := map[string]Work{}
+
+	err := openLibraryRecords(r, func(record map[string]interface{}) error {
+		key, _ := record["key"].(string)
+		name, _ := record["name"].(string)
+
+		if len(key) > 0 && len(name) > 0 {
+			viaf := ""
+
+			if remote, ok := record["remote_ids"].(map[string]interface{}); ok {
+				viaf, _ = remote["viaf"].(string)
+			}
+
+			authors[key] = Work{
+				Author: name,
+				VIAF:   viaf,
+				OLID:   key,
+			}
+		}
+
+		return nil
+	})
+
+	return authors, err
+}
+
+// Popular works have more editions, so count them.
+func readOpenLibraryEditions(r io.Reader) (map[string]int, error) {
+	counts := map[string]int{}
+
+	err := openLibraryRecords(r, func(record map[string]interface{}) error {
+		list, _ := record["works"].([]interface{})
+
+		for _, entry := range list {
+			if entry, ok := entry.(map[string]interface{}); ok {
+				if key, ok := entry["key"].(string); ok {
+					counts[key]++
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return counts, err
+}
+
+func readOpenLibraryWorks(r io.Reader, authors map[string]Work, editions map[string]int, fn func(Work) error) error {
+	return openLibraryRecords(r, func(record map[string]interface{}) error {
+		title, _ := record["title"].(string)
+		work, _ := record["key"].(string)
+		list, _ := record["authors"].([]interface{})
+
+		for _, entry := range list {
+			if entry, ok := entry.(map[string]interface{}); ok {
+				if ref, ok := entry["author"].(map[string]interface{}); ok {
+					key, _ := ref["key"].(string)
+
+					if author, ok := authors[key]; ok && len(title) > 0 {
+						author.Title = title
+						author.Popularity = editions[work]
+
+						if err := fn(author); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func createIndex(es *elasticsearch.Client, index string, recreate bool) error {
+	res, err := es.Indices.Exists([]string{index})
+
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	exists := res.StatusCode == 200
+
+	if exists && recreate {
+		sugar.Infof("Delete index %s", index)
+		res, err = es.Indices.Delete([]string{index})
+
+		if err != nil {
+			return err
+		}
+
+		res.Body.Close()
+
+		if res.IsError() {
+			return fmt.Errorf("failed to delete index %s: %s", index, res.Status())
+		}
+
+		exists = false
+	}
+
+	if !exists {
+		var buf bytes.Buffer
+
+		if err := json.NewEncoder(&buf).Encode(indexMapping); err != nil {
+			return err
+		}
+
+		sugar.Infof("Create index %s", index)
+		res, err = es.Indices.Create(index, es.Indices.Create.WithBody(&buf))
+
+		if err != nil {
+			return err
+		}
+
+		defer res.Body.Close()
+
+		if res.IsError() {
+			return fmt.Errorf("failed to create index %s: %s", index, res.String())
+		}
+	}
+
+	return nil
+}
+
+// Record when we loaded the index in its metadata, which is part of the version the search cache uses.
+func markLoaded(es *elasticsearch.Client, index string) error {
+	var buf bytes.Buffer
+
+	meta := map[string]interface{}{
+		"_meta": map[string]interface{}{
+			"loaded": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}
+
+	if err := json.NewEncoder(&buf).Encode(meta); err != nil {
+		return err
+	}
+
+	res, err := es.Indices.PutMapping(&buf, es.Indices.PutMapping.WithIndex(index))
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("failed to update index %s: %s", index, res.String())
+	}
+
+	return nil
+}
+
+// Accumulates documents and sends them in bulk requests.
+type bulkLoader struct {
+	es      *elasticsearch.Client
+	index   string
+	batch   int
+	pending int
+	count   int
+	buf     bytes.Buffer
+}
+
+// The id of a work in the index, so that loading the same dump again replaces the works rather than adding another
+// copy of each.  Works from Open Library don't always have a VIAF id, so then we go by the Open Library author, and
+// failing that the name.  Titles can be long, and ids can't, so we hash it.
+func workID(work Work) string {
+	key := work.VIAF
+
+	if len(key) == 0 && len(work.OLID) > 0 {
+		key = "olid:" + work.OLID
+	} else if len(key) == 0 {
+		key = "author:" + work.NormalAuthor
+	}
+
+	sum := sha1.Sum([]byte(key + "\x00" + work.NormalTitle))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (l *bulkLoader) add(work Work) error {
+	action := map[string]interface{}{
+		"index": map[string]string{"_id": workID(work)},
+	}
+
+	if err := json.NewEncoder(&l.buf).Encode(action); err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(&l.buf).Encode(work); err != nil {
+		return err
+	}
+
+	l.pending++
+
+	if l.pending >= l.batch {
+		return l.flush()
+	}
+
+	return nil
+}
+
+func (l *bulkLoader) flush() error {
+	if l.pending == 0 {
+		return nil
+	}
+
+	res, err := l.es.Bulk(bytes.NewReader(l.buf.Bytes()),
+		l.es.Bulk.WithContext(context.Background()),
+		l.es.Bulk.WithIndex(l.index),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("bulk load failed: %s", res.String())
+	}
+
+	var r struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error map[string]interface{} `json:"error"`
+		} `json:"items"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return err
+	}
+
+	if r.Errors {
+		for _, item := range r.Items {
+			for _, result := range item {
+				if result.Error != nil {
+					return fmt.Errorf("bulk load failed: %s: %s", result.Error["type"], result.Error["reason"])
+				}
+			}
+		}
+	}
+
+	l.count += l.pending
+	l.pending = 0
+	l.buf.Reset()
+	sugar.Infof("Indexed %d", l.count)
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const VIAF_DUMP = "viaf/54234133\t<ns1:VIAFCluster xmlns:ns1=\"http://viaf.org/viaf/terms#\"><ns1:viafID>54234133</ns1:viafID><ns1:nameType>Personal</ns1:nameType><ns1:mainHeadings><ns1:data><ns1:text>Mansell, Jill, 1957-</ns1:text></ns1:data></ns1:mainHeadings><ns1:titles><ns1:work id=\"1\"><ns1:title>Mixed doubles</ns1:title><ns1:sources><ns1:s>LC|n 00000001</ns1:s><ns1:s>BNF|00000001</ns1:s></ns1:sources></ns1:work><ns1:work id=\"2\"><ns1:title>Thinking of you</ns1:title></ns1:work></ns1:titles></ns1:VIAFCluster>\n" +
+	"viaf/1\t<ns1:VIAFCluster xmlns:ns1=\"http://viaf.org/viaf/terms#\"><ns1:viafID>1</ns1:viafID><ns1:nameType>Corporate</ns1:nameType><ns1:mainHeadings><ns1:data><ns1:text>Vintage</ns1:text></ns1:data></ns1:mainHeadings><ns1:titles><ns1:work id=\"1\"><ns1:title>Catalogue</ns1:title></ns1:work></ns1:titles></ns1:VIAFCluster>\n" +
+	"junk\n"
+
+const OL_AUTHORS = "/type/author\t/authors/OL1A\t1\t2020-01-01\t{\"key\": \"/authors/OL1A\", \"name\": \"Henning Mankell\", \"remote_ids\": {\"viaf\": \"67890\"}}\n" +
+	"/type/author\t/authors/OL2A\t1\t2020-01-01\t{\"key\": \"/authors/OL2A\", \"name\": \"Andrew Marr\"}\n"
+
+const OL_WORKS = "/type/work\t/works/OL1W\t1\t2020-01-01\t{\"key\": \"/works/OL1W\", \"title\": \"The Fifth Woman\", \"authors\": [{\"author\": {\"key\": \"/authors/OL1A\"}}]}\n" +
+	"/type/work\t/works/OL2W\t1\t2020-01-01\t{\"key\": \"/works/OL2W\", \"title\": \"Head of State\", \"authors\": [{\"author\": {\"key\": \"/authors/OL2A\"}}, {\"author\": {\"key\": \"/authors/OL3A\"}}]}\n"
+
+const OL_EDITIONS = "/type/edition\t/books/OL1M\t1\t2020-01-01\t{\"works\": [{\"key\": \"/works/OL1W\"}]}\n" +
+	"/type/edition\t/books/OL2M\t1\t2020-01-01\t{\"works\": [{\"key\": \"/works/OL1W\"}]}\n"
+
+func collectDump(t *testing.T, dump string, format string, authors string, editions string) []Work {
+	works := []Work{}
+	err := readDump(strings.NewReader(dump), format, strings.NewReader(authors), strings.NewReader(editions), func(work Work) error {
+		works = append(works, work)
+		return nil
+	})
+
+	assert.Nil(t, err)
+
+	return works
+}
+
+func TestReadVIAF(t *testing.T) {
+	assert.Equal(t, "Jill Mansell", viafAuthor("Mansell, Jill, 1957-"))
+	assert.Equal(t, "Homer", viafAuthor("Homer"))
+
+	works := collectDump(t, VIAF_DUMP, "viaf", "", "")
+	assert.Equal(t, 2, len(works))
+	assert.Equal(t, "Jill Mansell", works[0].Author)
+	assert.Equal(t, "Mixed doubles", works[0].Title)
+	assert.Equal(t, "54234133", works[1].VIAF)
+	assert.Equal(t, 2, works[0].Popularity)
+	assert.Equal(t, 0, works[1].Popularity)
+}
+
+func TestReadOpenLibrary(t *testing.T) {
+	works := collectDump(t, OL_WORKS, "openlibrary", OL_AUTHORS, OL_EDITIONS)
+	assert.Equal(t, 2, len(works))
+	assert.Equal(t, "Henning Mankell", works[0].Author)
+	assert.Equal(t, "67890", works[0].VIAF)
+	assert.Equal(t, "Head of State", works[1].Title)
+	assert.Equal(t, "/authors/OL1A", works[0].OLID)
+	assert.Equal(t, "", works[1].VIAF)
+	assert.Equal(t, "/authors/OL2A", works[1].OLID)
+	assert.Equal(t, 2, works[0].Popularity)
+	assert.Equal(t, 0, works[1].Popularity)
+}
+
+func TestBulkLoaderIDs(t *testing.T) {
+	ids := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &action))
+			ids = append(ids, action["index"]["_id"])
+			scanner.Scan()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors": false, "items": []}`))
+	}))
+	defer server.Close()
+
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}, DisableRetry: true})
+	assert.Nil(t, err)
+
+	loader := &bulkLoader{es: es, index: "booktastic", batch: 10}
+	dark := Work{Author: "Stephen King", Title: "The Dark Tower", NormalAuthor: "king stephen", NormalTitle: "dark tower", VIAF: "97113511"}
+	cell := Work{Author: "Stephen King", Title: "Cell", NormalAuthor: "king stephen", NormalTitle: "cell", VIAF: "97113511"}
+	noviaf := Work{Author: "Someone Else", Title: "The Dark Tower", NormalAuthor: "else someone", NormalTitle: "dark tower"}
+
+	// Loading the same work again, say from a second run of the index, replaces it.
+	for _, work := range []Work{dark, cell, noviaf, dark} {
+		assert.Nil(t, loader.add(work))
+	}
+
+	assert.Nil(t, loader.flush())
+	assert.Equal(t, 4, len(ids))
+	assert.Equal(t, ids[0], ids[3])
+	assert.NotEqual(t, ids[0], ids[1])
+	assert.NotEqual(t, ids[0], ids[2])
+	assert.Equal(t, workID(dark), ids[0])
+
+	// Authors without a VIAF id are told apart by their Open Library key.
+	marr := Work{Author: "Andrew Marr", NormalAuthor: "marr andrew", NormalTitle: "head state", OLID: "/authors/OL2A"}
+	other := marr
+	other.OLID = "/authors/OL9A"
+	assert.NotEqual(t, workID(marr), workID(other))
+}
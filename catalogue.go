@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// A Work is a single catalogue entry - one title by one author.  We match against the normalised values but
+// report the original ones.
+type Work struct {
+	Author       string `json:"author"`
+	Title        string `json:"title"`
+	NormalAuthor string `json:"normalauthor"`
+	NormalTitle  string `json:"normaltitle"`
+	VIAF         string `json:"viafid"`
+	OLID         string `json:"olid,omitempty"` // Open Library author key, for works from there
+	Popularity   int    `json:"popularity"`     // Editions, holdings or similar; 0 if we don't know
+}
+
+// Catalogue is the store of known works which we search against.  Authors and titles passed in have already been
+// normalised.  Results are returned in order of relevance, best first, and there are at most size of them.
+type Catalogue interface {
+	// Fuzzy match on the author, preferring works whose title matches exactly.
+	SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error)
+
+	// Fuzzy match on the title, preferring works whose author matches exactly.
+	SearchTitle(ctx context.Context, author string, title string, size int) ([]Work, error)
+
+	// Fuzzy match on both the author and the title.
+	SearchAuthorTitle(ctx context.Context, author string, title string, size int) ([]Work, error)
+
+	// All works by the author with this VIAF id.
+	WorksByVIAF(ctx context.Context, viafid string, size int) ([]Work, error)
+}
+
+// Catalogue records are loosely typed (the VIAF id might be a number, for example), so convert field by field.  VIAF
+// ids can be 22 digits, which is more than a float holds, so decode with UseNumber where we can.
+func workFromSource(source map[string]interface{}) Work {
+	field := func(name string) string {
+		switch v := source[name].(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		case float64:
+			// Too late to get back any precision we've lost, but at least don't give an exponent.
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Sprintf("%v", v)
+		}
+	}
+
+	popularity, _ := strconv.ParseFloat(field("popularity"), 64)
+
+	return Work{
+		Author:       field("author"),
+		Title:        field("title"),
+		NormalAuthor: field("normalauthor"),
+		NormalTitle:  field("normaltitle"),
+		VIAF:         field("viafid"),
+		OLID:         field("olid"),
+		Popularity:   int(popularity),
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A catalogue which returns the same works whatever we ask, so that we can exercise the pipeline without a cluster.
+type stubCatalogue struct {
+	works []Work
+}
+
+func (c *stubCatalogue) SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.works, nil
+}
+
+func (c *stubCatalogue) SearchTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.works, nil
+}
+
+func (c *stubCatalogue) SearchAuthorTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.works, nil
+}
+
+func (c *stubCatalogue) WorksByVIAF(ctx context.Context, viafid string, size int) ([]Work, error) {
+	return c.works, nil
+}
+
+// A catalogue where every search fails.
+type failingCatalogue struct {
+	err error
+}
+
+func (c *failingCatalogue) SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return []Work{}, c.err
+}
+
+func (c *failingCatalogue) SearchTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return []Work{}, c.err
+}
+
+func (c *failingCatalogue) SearchAuthorTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return []Work{}, c.err
+}
+
+func (c *failingCatalogue) WorksByVIAF(ctx context.Context, viafid string, size int) ([]Work, error) {
+	return []Work{}, c.err
+}
+
+func TestStubCatalogue(t *testing.T) {
+	identifier := NewIdentifier(&stubCatalogue{
+		works: []Work{
+			{
+				Author:       "Edward Marston",
+				Title:        "Dance of Death",
+				NormalAuthor: "edward marston",
+				NormalTitle:  "dance death",
+				VIAF:         "12345",
+			},
+		},
+	})
+
+	spines := []Spine{
+		{Spine: "EDWARD MARSTON DANCE OF DEATH"},
+		{Spine: "VINTAGE"},
+	}
+
+	spines, _, err := identifier.IdentifyBooks(context.Background(), spines, []OCRFragment{})
+	assert.Nil(t, err)
+	assert.Equal(t, "Edward Marston", spines[0].Author)
+	assert.Equal(t, "Dance of Death", spines[0].Title)
+	assert.Equal(t, "12345", spines[0].VIAF)
+	assert.True(t, spines[0].Confidence >= CONFIDENCE)
+	assert.Equal(t, "", spines[1].Author)
+	assert.Equal(t, 0, spines[1].Confidence)
+}
+
+func TestSearchErrors(t *testing.T) {
+	identifier := NewIdentifier(&failingCatalogue{err: errors.New("no cluster")})
+
+	spines := []Spine{
+		{Spine: "EDWARD MARSTON DANCE OF DEATH"},
+	}
+
+	spines, _, err := identifier.IdentifyBooks(context.Background(), spines, []OCRFragment{})
+	assert.NotNil(t, err)
+	assert.Equal(t, "no cluster", err.(*SearchError).Errors[0].Error())
+
+	// We still get the spines back.
+	assert.Equal(t, 1, len(spines))
+	assert.Equal(t, "EDWARD MARSTON DANCE OF DEATH", spines[0].Spine)
+}
+
+// A catalogue which takes its time, but gives up when asked to.
+type slowCatalogue struct {
+	stubCatalogue
+	delay time.Duration
+}
+
+func (c *slowCatalogue) SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	select {
+	case <-time.After(c.delay):
+		return c.works, nil
+	case <-ctx.Done():
+		return []Work{}, ctx.Err()
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	identifier := NewIdentifier(&slowCatalogue{delay: time.Second})
+
+	spines := []Spine{
+		{Spine: "EDWARD MARSTON DANCE OF DEATH"},
+		{Spine: "HENNING MANKELL THE FIFTH WOMAN"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	spines, _, err := identifier.IdentifyBooks(ctx, spines, []OCRFragment{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 2, len(spines))
+}
+
+func TestConcurrentIdentifiers(t *testing.T) {
+	// Each Identifier has its own catalogue and results, so running them side by side mustn't mix them up.
+	catalogues := []Catalogue{
+		&stubCatalogue{
+			works: []Work{
+				{Author: "Edward Marston", Title: "Dance of Death", NormalAuthor: "edward marston", NormalTitle: "dance death", VIAF: "12345"},
+			},
+		},
+		&stubCatalogue{
+			works: []Work{
+				{Author: "Henning Mankell", Title: "The Fifth Woman", NormalAuthor: "henning mankell", NormalTitle: "fifth woman", VIAF: "67890"},
+			},
+		},
+	}
+
+	shelves := [][]Spine{
+		{{Spine: "EDWARD MARSTON DANCE OF DEATH"}},
+		{{Spine: "HENNING MANKELL THE FIFTH WOMAN"}},
+	}
+
+	results := make([][]Spine, len(shelves))
+	errs := make([]error, len(shelves))
+	var wg sync.WaitGroup
+
+	for i := range shelves {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, errs[i] = NewIdentifier(catalogues[i]).IdentifyBooks(context.Background(), shelves[i], []OCRFragment{})
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Equal(t, "Dance of Death", results[0][0].Title)
+	assert.Equal(t, "The Fifth Woman", results[1][0].Title)
+}
+
+func TestCandidates(t *testing.T) {
+	identifier := NewIdentifier(&stubCatalogue{
+		works: []Work{
+			{Author: "Edward Marston", Title: "Dances of Death", NormalAuthor: "edward marston", NormalTitle: "dances death", VIAF: "12345"},
+			{Author: "Edward Marston", Title: "Dance of Death", NormalAuthor: "edward marston", NormalTitle: "dance death", VIAF: "12345"},
+		},
+	})
+
+	spines := []Spine{
+		{Spine: "EDWARD MARSTON DANCE OF DEATH"},
+	}
+
+	spines, _, err := identifier.IdentifyBooks(context.Background(), spines, []OCRFragment{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(spines[0].Candidates))
+
+	// Best first, whichever we happened to find first.
+	assert.Equal(t, "Dance of Death", spines[0].Candidates[0].Title)
+	assert.Equal(t, "Dances of Death", spines[0].Candidates[1].Title)
+	assert.True(t, spines[0].Candidates[0].Confidence > spines[0].Candidates[1].Confidence)
+
+	identifier.MaxCandidates = 0
+	spines, _, _ = identifier.IdentifyBooks(context.Background(), []Spine{{Spine: "EDWARD MARSTON DANCE OF DEATH"}}, []OCRFragment{})
+	assert.Nil(t, spines[0].Candidates)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How we connect to Elasticsearch.  Values come from (in increasing order of precedence) the defaults, a JSON config
+// file, BOOKTASTIC_ES_* environment variables and command line flags.
+type ElasticConfig struct {
+	Addresses []string      `json:"addresses"`
+	Index     string        `json:"index"`
+	Username  string        `json:"username"`
+	Password  string        `json:"password"`
+	APIKey    string        `json:"apikey"`
+	CACert    string        `json:"cacert"`  // Path to a PEM file
+	Timeout   time.Duration `json:"-"`       // Per request; 0 for none
+	Batch     int           `json:"batch"`   // Most searches to send in one _msearch; 1 or less sends them singly
+	CacheDir  string        `json:"cache"`   // Directory for the persistent search cache; empty for none
+	CacheTTL  time.Duration `json:"-"`       // How long cached searches last; 0 for ever
+	CacheMB   int           `json:"cachemb"` // Most the cache may hold on disk; 0 for no limit
+}
+
+func defaultElasticConfig() ElasticConfig {
+	return ElasticConfig{
+		Addresses: []string{
+			"http://elastic1:9200",
+			"http://elastic2:9200",
+		},
+		Index:    "booktastic",
+		Timeout:  30 * time.Second,
+		Batch:    50,
+		CacheTTL: 7 * 24 * time.Hour,
+		CacheMB:  512,
+	}
+}
+
+// The flags we have for the config.  We hold them separately so that we can tell which were actually given.
+type elasticFlags struct {
+	flags     *flag.FlagSet
+	config    *string
+	addresses *string
+	index     *string
+	username  *string
+	password  *string
+	apikey    *string
+	cacert    *string
+	timeout   *time.Duration
+	batch     *int
+	cacheDir  *string
+	cacheTTL  *time.Duration
+	cacheMB   *int
+}
+
+func addElasticFlags(flags *flag.FlagSet) *elasticFlags {
+	return &elasticFlags{
+		flags:     flags,
+		config:    flags.String("config", "", "JSON config file for the Elasticsearch connection"),
+		addresses: flags.String("es", "", "Comma-separated Elasticsearch addresses"),
+		index:     flags.String("index", "", "Elasticsearch index"),
+		username:  flags.String("es-user", "", "Elasticsearch username"),
+		password:  flags.String("es-password", "", "Elasticsearch password"),
+		apikey:    flags.String("es-api-key", "", "Elasticsearch API key"),
+		cacert:    flags.String("es-ca-cert", "", "CA certificate (PEM) for Elasticsearch"),
+		timeout:   flags.Duration("es-timeout", 0, "Elasticsearch request timeout"),
+		batch:     flags.Int("es-batch", 0, "Most searches to combine into one Elasticsearch request"),
+		cacheDir:  flags.String("es-cache", "", "Directory to keep Elasticsearch results in between runs"),
+		cacheTTL:  flags.Duration("es-cache-ttl", 0, "How long to keep cached Elasticsearch results"),
+		cacheMB:   flags.Int("es-cache-mb", 0, "Most megabytes of Elasticsearch results to keep"),
+	}
+}
+
+// Work out the config from all our sources.  Call after the flags have been parsed.
+func (f *elasticFlags) resolve() (ElasticConfig, error) {
+	cfg := defaultElasticConfig()
+
+	file := os.Getenv("BOOKTASTIC_CONFIG")
+
+	if len(*f.config) > 0 {
+		file = *f.config
+	}
+
+	if len(file) > 0 {
+		if err := cfg.load(file); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := cfg.fromEnv(); err != nil {
+		return cfg, err
+	}
+
+	set := map[string]bool{}
+	f.flags.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	if set["es"] {
+		cfg.Addresses = splitAddresses(*f.addresses)
+	}
+
+	if set["index"] {
+		cfg.Index = *f.index
+	}
+
+	if set["es-user"] {
+		cfg.Username = *f.username
+	}
+
+	if set["es-password"] {
+		cfg.Password = *f.password
+	}
+
+	if set["es-api-key"] {
+		cfg.APIKey = *f.apikey
+	}
+
+	if set["es-ca-cert"] {
+		cfg.CACert = *f.cacert
+	}
+
+	if set["es-timeout"] {
+		cfg.Timeout = *f.timeout
+	}
+
+	if set["es-batch"] {
+		cfg.Batch = *f.batch
+	}
+
+	if set["es-cache"] {
+		cfg.CacheDir = *f.cacheDir
+	}
+
+	if set["es-cache-ttl"] {
+		cfg.CacheTTL = *f.cacheTTL
+	}
+
+	if set["es-cache-mb"] {
+		cfg.CacheMB = *f.cacheMB
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (cfg *ElasticConfig) load(file string) error {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	// The durations are strings such as "10s", which don't decode directly.
+	var raw struct {
+		ElasticConfig
+		Timeout  string `json:"timeout"`
+		CacheTTL string `json:"cachettl"`
+	}
+
+	raw.ElasticConfig = *cfg
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	*cfg = raw.ElasticConfig
+
+	if len(raw.Timeout) > 0 {
+		if cfg.Timeout, err = time.ParseDuration(raw.Timeout); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+
+	if len(raw.CacheTTL) > 0 {
+		if cfg.CacheTTL, err = time.ParseDuration(raw.CacheTTL); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *ElasticConfig) fromEnv() error {
+	if v := os.Getenv("BOOKTASTIC_ES_ADDRESSES"); len(v) > 0 {
+		cfg.Addresses = splitAddresses(v)
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_INDEX"); len(v) > 0 {
+		cfg.Index = v
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_USERNAME"); len(v) > 0 {
+		cfg.Username = v
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_PASSWORD"); len(v) > 0 {
+		cfg.Password = v
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_API_KEY"); len(v) > 0 {
+		cfg.APIKey = v
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_CA_CERT"); len(v) > 0 {
+		cfg.CACert = v
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_TIMEOUT"); len(v) > 0 {
+		timeout, err := time.ParseDuration(v)
+
+		if err != nil {
+			return fmt.Errorf("BOOKTASTIC_ES_TIMEOUT: %s", err)
+		}
+
+		cfg.Timeout = timeout
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_BATCH"); len(v) > 0 {
+		batch, err := strconv.Atoi(v)
+
+		if err != nil {
+			return fmt.Errorf("BOOKTASTIC_ES_BATCH: %s", err)
+		}
+
+		cfg.Batch = batch
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_CACHE"); len(v) > 0 {
+		cfg.CacheDir = v
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_CACHE_TTL"); len(v) > 0 {
+		ttl, err := time.ParseDuration(v)
+
+		if err != nil {
+			return fmt.Errorf("BOOKTASTIC_ES_CACHE_TTL: %s", err)
+		}
+
+		cfg.CacheTTL = ttl
+	}
+
+	if v := os.Getenv("BOOKTASTIC_ES_CACHE_MB"); len(v) > 0 {
+		mb, err := strconv.Atoi(v)
+
+		if err != nil {
+			return fmt.Errorf("BOOKTASTIC_ES_CACHE_MB: %s", err)
+		}
+
+		cfg.CacheMB = mb
+	}
+
+	return nil
+}
+
+func (cfg *ElasticConfig) validate() error {
+	if len(cfg.Addresses) == 0 {
+		return errors.New("no Elasticsearch addresses configured")
+	}
+
+	if len(cfg.Index) == 0 {
+		return errors.New("no Elasticsearch index configured")
+	}
+
+	if cfg.Timeout < 0 {
+		return errors.New("Elasticsearch timeout must not be negative")
+	}
+
+	if cfg.CacheTTL < 0 || cfg.CacheMB < 0 {
+		return errors.New("cache limits must not be negative")
+	}
+
+	return nil
+}
+
+// The transport we need for a custom CA, or nil for the default.
+func (cfg *ElasticConfig) transport() (http.RoundTripper, error) {
+	if len(cfg.CACert) == 0 {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(cfg.CACert)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: pool,
+	}
+
+	return transport, nil
+}
+
+func splitAddresses(str string) []string {
+	addresses := []string{}
+
+	for _, address := range strings.Split(str, ",") {
+		address = strings.TrimSpace(address)
+
+		if len(address) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestElasticConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "booktastic")
+	defer os.RemoveAll(dir)
+	cfn := filepath.Join(dir, "config.json")
+	_ = ioutil.WriteFile(cfn, []byte(`{"addresses": ["https://staging:9200"], "index": "staging", "username": "user", "timeout": "5s", "cachettl": "1h"}`), 0644)
+
+	// Defaults.
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	esFlags := addElasticFlags(flags)
+	assert.Nil(t, flags.Parse([]string{}))
+	cfg, err := esFlags.resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://elastic1:9200", "http://elastic2:9200"}, cfg.Addresses)
+	assert.Equal(t, "booktastic", cfg.Index)
+
+	// File, then environment, then flags.
+	os.Setenv("BOOKTASTIC_ES_INDEX", "fromenv")
+	defer os.Unsetenv("BOOKTASTIC_ES_INDEX")
+
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	esFlags = addElasticFlags(flags)
+	assert.Nil(t, flags.Parse([]string{"-config", cfn, "-es-password", "secret"}))
+	cfg, err = esFlags.resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://staging:9200"}, cfg.Addresses)
+	assert.Equal(t, "fromenv", cfg.Index)
+	assert.Equal(t, "user", cfg.Username)
+	assert.Equal(t, "secret", cfg.Password)
+	assert.Equal(t, 5*time.Second, cfg.Timeout)
+	assert.Equal(t, time.Hour, cfg.CacheTTL)
+
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	esFlags = addElasticFlags(flags)
+	assert.Nil(t, flags.Parse([]string{"-config", cfn, "-index", "fromflag", "-es", "http://a:9200, http://b:9200"}))
+	cfg, err = esFlags.resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://a:9200", "http://b:9200"}, cfg.Addresses)
+	assert.Equal(t, "fromflag", cfg.Index)
+
+	// Errors.
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	esFlags = addElasticFlags(flags)
+	assert.Nil(t, flags.Parse([]string{"-es", ""}))
+	_, err = esFlags.resolve()
+	assert.NotNil(t, err)
+
+	// No timeout at all is fine, but a negative one isn't.
+	cfg = defaultElasticConfig()
+	cfg.Timeout = 0
+	assert.Nil(t, cfg.validate())
+	cfg.Timeout = -time.Second
+	assert.NotNil(t, cfg.validate())
+
+	cfg = defaultElasticConfig()
+	cfg.CACert = filepath.Join(dir, "missing.pem")
+	_, err = cfg.transport()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The characters we try when correcting a word.  Normalised authors and titles contain nothing else.
+const DICTIONARY_LETTERS = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Words this short are dropped by normalisation, so there's no point correcting them.
+const DICTIONARY_MIN_WORD = 4
+
+// A dictionary is the vocabulary of the catalogue - every word in the normalised authors and titles, with how often
+// it appears.  OCR mistakes are usually a single wrong letter, and the most common word one letter away is usually
+// what was printed on the spine.
+type dictionary struct {
+	words map[string]int
+}
+
+func newDictionary() *dictionary {
+	return &dictionary{
+		words: map[string]int{},
+	}
+}
+
+func (d *dictionary) add(work Work) {
+	for _, word := range strings.Fields(work.NormalAuthor + " " + work.NormalTitle) {
+		d.words[word]++
+	}
+}
+
+// The file is one word per line with its count, most common first.  buildIndex writes it as it loads the works.
+func loadDictionary(filename string) (*dictionary, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	d, err := readDictionary(f)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	sugar.Infof("Loaded %d words from %s", len(d.words), filename)
+
+	return d, nil
+}
+
+func readDictionary(r io.Reader) (*dictionary, error) {
+	d := newDictionary()
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a word and a count", line)
+		}
+
+		count, err := strconv.Atoi(fields[1])
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		d.words[fields[0]] += count
+	}
+
+	return d, scanner.Err()
+}
+
+func (d *dictionary) write(w io.Writer) error {
+	words := make([]string, 0, len(d.words))
+
+	for word := range d.words {
+		words = append(words, word)
+	}
+
+	sort.Slice(words, func(i, j int) bool {
+		if d.words[words[i]] != d.words[words[j]] {
+			return d.words[words[i]] > d.words[words[j]]
+		}
+
+		return words[i] < words[j]
+	})
+
+	bw := bufio.NewWriter(w)
+
+	for _, word := range words {
+		if _, err := fmt.Fprintf(bw, "%s %d\n", word, d.words[word]); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Correct each word in some spine text, keeping the spacing simple.
+func (d *dictionary) correctText(text string) string {
+	words := strings.Fields(text)
+
+	for i, word := range words {
+		words[i] = d.correct(word)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// The most likely word that the OCR meant.  Punctuation around the word and the case of the letters are kept, so the
+// text still looks like the spine.
+func (d *dictionary) correct(word string) string {
+	start := strings.IndexFunc(word, isWordChar)
+
+	if start < 0 {
+		return word
+	}
+
+	end := strings.LastIndexFunc(word, isWordChar) + 1
+	core := word[start:end]
+
+	if initials, ok := dottedInitials(core, word[end:]); ok {
+		return word[:start] + initials
+	}
+
+	lower := strings.ToLower(core)
+
+	if len(lower) < DICTIONARY_MIN_WORD || strings.IndexFunc(lower, func(r rune) bool { return !isWordChar(r) }) >= 0 {
+		// Too short to matter, or something like O'Brien which we don't have in this form.
+		return word
+	}
+
+	if d.words[lower] > 0 {
+		return word
+	}
+
+	best := ""
+	bestcount := 0
+
+	for _, candidate := range edits(lower) {
+		if count := d.words[candidate]; count > bestcount || (count == bestcount && count > 0 && candidate < best) {
+			best = candidate
+			bestcount = count
+		}
+	}
+
+	if bestcount == 0 {
+		return word
+	}
+
+	sugar.Debugf("Correct %s to %s, seen %d times", core, best, bestcount)
+
+	return word[:start] + matchCase(best, core) + word[end:]
+}
+
+func isWordChar(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// Abbreviations which look like initials but aren't.
+var notInitials = map[string]bool{
+	"DR":  true,
+	"ED":  true,
+	"JR":  true,
+	"MR":  true,
+	"MRS": true,
+	"MS":  true,
+	"NO":  true,
+	"SR":  true,
+	"ST":  true,
+	"VOL": true,
+}
+
+// Initials often lose their inner dots, so that J.R.R. comes out as J.RR. or RR.  Normalisation drops them anyway,
+// but the search text is reported back so it's worth getting right.  Three letters could just as well be a word at
+// the end of a sentence, so we only believe those if some of the dots survived.
+func dottedInitials(core string, after string) (string, bool) {
+	if !strings.HasPrefix(after, ".") {
+		return "", false
+	}
+
+	letters := strings.Replace(core, ".", "", -1)
+
+	if len(letters) < 2 || len(letters) > 3 || (len(letters) == 3 && letters == core) || notInitials[letters] ||
+		strings.ToUpper(letters) != letters || strings.IndexFunc(letters, unicode.IsDigit) >= 0 {
+		return "", false
+	}
+
+	return strings.Join(strings.Split(letters, ""), ".") + after, true
+}
+
+// Every string one deletion, transposition, replacement or insertion away.
+func edits(word string) []string {
+	ret := []string{}
+
+	for i := 0; i <= len(word); i++ {
+		left, right := word[:i], word[i:]
+
+		if len(right) > 0 {
+			ret = append(ret, left+right[1:])
+		}
+
+		if len(right) > 1 {
+			ret = append(ret, left+right[1:2]+right[0:1]+right[2:])
+		}
+
+		for _, c := range DICTIONARY_LETTERS {
+			if len(right) > 0 {
+				ret = append(ret, left+string(c)+right[1:])
+			}
+
+			ret = append(ret, left+string(c)+right)
+		}
+	}
+
+	return ret
+}
+
+// Put a lower case word into the same case as the original - spines are often all capitals.
+func matchCase(word string, original string) string {
+	switch {
+	case strings.ToUpper(original) == original:
+		return strings.ToUpper(word)
+	case strings.Title(strings.ToLower(original)) == original:
+		return strings.Title(word)
+	}
+
+	return word
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testDictionary() *dictionary {
+	d := newDictionary()
+
+	for _, work := range []Work{
+		{NormalAuthor: "king stephen", NormalTitle: "dark tower"},
+		{NormalAuthor: "king stephen", NormalTitle: "tower"},
+		{NormalAuthor: "tolkien", NormalTitle: "hobbit"},
+		{NormalAuthor: "lower", NormalTitle: "power"},
+	} {
+		d.add(work)
+	}
+
+	return d
+}
+
+func TestDictionary(t *testing.T) {
+	d := testDictionary()
+	assert.Equal(t, 2, d.words["tower"])
+
+	// Tower is more common than lower or power.
+	assert.Equal(t, "TOWER", d.correct("JOWER"))
+	assert.Equal(t, "Tower,", d.correct("Jower,"))
+	assert.Equal(t, "(hobbit)", d.correct("(hobbip)"))
+	assert.Equal(t, "R.R.", d.correct("RR."))
+	assert.Equal(t, "J.R.R.", d.correct("J.RR."))
+
+	// Known words, short ones, abbreviations and things we've nothing close to are left alone.
+	assert.Equal(t, "KING", d.correct("KING"))
+	assert.Equal(t, "THE", d.correct("THE"))
+	assert.Equal(t, "DR.", d.correct("DR."))
+	assert.Equal(t, "END.", d.correct("END."))
+	assert.Equal(t, "VINTAGE", d.correct("VINTAGE"))
+	assert.Equal(t, "...", d.correct("..."))
+
+	assert.Equal(t, "J.R.R. TOLKIEN THE HOBBIT", d.correctText("J.RR. TOLKIEN THE HOBBIT"))
+
+	// And back again.
+	var buf bytes.Buffer
+	assert.Nil(t, d.write(&buf))
+	assert.True(t, strings.HasPrefix(buf.String(), "king 2\nstephen 2\ntower 2\n"))
+
+	read, err := readDictionary(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, d.words, read.words)
+
+	_, err = readDictionary(strings.NewReader("tower two\n"))
+	assert.NotNil(t, err)
+}
+
+// A catalogue which remembers the titles it was asked for.
+type recordingCatalogue struct {
+	stubCatalogue
+	mux    sync.Mutex
+	titles []string
+}
+
+func (c *recordingCatalogue) record(title string) ([]Work, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.titles = append(c.titles, title)
+	return c.works, nil
+}
+
+func (c *recordingCatalogue) SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.record(title)
+}
+
+func (c *recordingCatalogue) SearchTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.record(title)
+}
+
+func (c *recordingCatalogue) SearchAuthorTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.record(title)
+}
+
+func TestFuzzyPhase(t *testing.T) {
+	c := &recordingCatalogue{}
+	identifier := NewIdentifier(c)
+	identifier.Dictionary = testDictionary()
+
+	_, _, err := identifier.IdentifyBooks(context.Background(), []Spine{{Spine: "STEPHEN KING THE DARK JOWER"}}, []OCRFragment{})
+	assert.Nil(t, err)
+	assert.Contains(t, c.titles, "dark tower")
+	assert.Contains(t, c.titles, "dark jower")
+}
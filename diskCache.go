@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many writes between checks that the cache hasn't grown too big.
+const DISK_CACHE_PRUNE_EVERY = 1000
+
+// Batch runs see the same shelves, and so the same searches, over and over.  The disk cache keeps search responses
+// between runs.  Entries are keyed on the query itself, and live in a directory for the index version, so that when
+// the index is rebuilt we start again.
+type diskCache struct {
+	dir    string
+	ttl    time.Duration
+	max    int64
+	mux    sync.Mutex
+	writes int64
+}
+
+// The version is anything which changes when the index contents do.  Cache directories for other versions of the
+// same index are out of date, so we remove them.
+func newDiskCache(root string, index string, version string, ttl time.Duration, max int64) (*diskCache, error) {
+	sum := sha256.Sum256([]byte(version))
+	name := index + "#" + hex.EncodeToString(sum[:8])
+
+	d := &diskCache{
+		dir: filepath.Join(root, name),
+		ttl: ttl,
+		max: max,
+	}
+
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), index+"#") && entry.Name() != name {
+			sugar.Infof("Index %s has changed, remove old cache %s", index, entry.Name())
+			os.RemoveAll(filepath.Join(root, entry.Name()))
+		}
+	}
+
+	d.prune()
+
+	return d, nil
+}
+
+func (d *diskCache) filename(query map[string]interface{}) string {
+	sum := sha256.Sum256([]byte(searchKey(query)))
+	key := hex.EncodeToString(sum[:])
+
+	return filepath.Join(d.dir, key[:2], key+".json")
+}
+
+// A nil cache is fine, and never finds anything.
+func (d *diskCache) get(query map[string]interface{}, size int) (map[string]interface{}, bool) {
+	if d == nil {
+		return nil, false
+	}
+
+	fn := d.filename(query)
+	info, err := os.Stat(fn)
+
+	if err != nil {
+		return nil, false
+	}
+
+	if d.ttl > 0 && time.Since(info.ModTime()) > d.ttl {
+		os.Remove(fn)
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, false
+	}
+
+	var s cachedSearch
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Probably a partial write from a run which died.  Search again and overwrite it.
+		sugar.Warnf("Corrupt cache entry %s: %s", fn, err)
+		return nil, false
+	}
+
+	if !s.covers(size) {
+		return nil, false
+	}
+
+	return s.hits(size), true
+}
+
+func (d *diskCache) put(query map[string]interface{}, size int, r map[string]interface{}) {
+	if d == nil {
+		return
+	}
+
+	data, err := json.Marshal(cachedSearch{
+		Size:     size,
+		Response: r,
+	})
+
+	if err != nil {
+		return
+	}
+
+	fn := d.filename(query)
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		sugar.Warnf("Failed to create cache directory for %s: %s", fn, err)
+		return
+	}
+
+	// Write then rename, so that other runs sharing the cache never see half an entry.
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), "tmp")
+
+	if err != nil {
+		sugar.Warnf("Failed to write cache entry %s: %s", fn, err)
+		return
+	}
+
+	_, err = tmp.Write(data)
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), fn)
+	}
+
+	if err != nil {
+		sugar.Warnf("Failed to write cache entry %s: %s", fn, err)
+		os.Remove(tmp.Name())
+		return
+	}
+
+	if atomic.AddInt64(&d.writes, 1)%DISK_CACHE_PRUNE_EVERY == 0 {
+		go d.prune()
+	}
+}
+
+// Remove entries which have expired, and then the oldest ones until we're within our size limit.
+func (d *diskCache) prune() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	type entry struct {
+		path string
+		size int64
+		mod  time.Time
+	}
+
+	entries := []entry{}
+	var total int64
+
+	filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		if d.ttl > 0 && time.Since(info.ModTime()) > d.ttl {
+			os.Remove(path)
+			return nil
+		}
+
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+
+		return nil
+	})
+
+	if d.max <= 0 || total <= d.max {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].mod.Before(entries[j].mod)
+	})
+
+	removed := 0
+
+	for _, e := range entries {
+		if total <= d.max {
+			break
+		}
+
+		if os.Remove(e.path) == nil {
+			total -= e.size
+			removed++
+		}
+	}
+
+	sugar.Infof("Pruned %d entries from cache %s", removed, d.dir)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "booktastic")
+	defer os.RemoveAll(dir)
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"normalauthor": "edward marston"},
+		},
+	}
+
+	r := map[string]interface{}{
+		"hits": map[string]interface{}{
+			"hits": []interface{}{},
+		},
+	}
+
+	d, err := newDiskCache(dir, "booktastic", "v1", time.Hour, 0)
+	assert.Nil(t, err)
+
+	_, found := d.get(query, 100)
+	assert.False(t, found)
+
+	d.put(query, 100, r)
+	got, found := d.get(query, 100)
+	assert.True(t, found)
+	assert.Equal(t, r, got)
+
+	// We found everything there is, so a bigger search can use it.
+	_, found = d.get(query, 500)
+	assert.True(t, found)
+
+	// But not if there might be more.
+	two := map[string]interface{}{
+		"hits": map[string]interface{}{
+			"hits": []interface{}{"first", "second"},
+		},
+	}
+
+	d.put(query, 2, two)
+	_, found = d.get(query, 5)
+	assert.False(t, found)
+	got, found = d.get(query, 1)
+	assert.True(t, found)
+	assert.Equal(t, []interface{}{"first"}, hitList(got))
+	assert.Equal(t, 2, len(hitList(two)))
+
+	d.put(query, 100, r)
+
+	// Another run against the same index sees the entry.
+	d, _ = newDiskCache(dir, "booktastic", "v1", time.Hour, 0)
+	_, found = d.get(query, 100)
+	assert.True(t, found)
+
+	// Expired.
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(d.filename(query), old, old)
+	_, found = d.get(query, 100)
+	assert.False(t, found)
+
+	// Rebuilding the index throws the old entries away.
+	d.put(query, 100, r)
+	d, _ = newDiskCache(dir, "booktastic", "v2", time.Hour, 0)
+	_, found = d.get(query, 100)
+	assert.False(t, found)
+	dirs, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(dirs))
+
+	// A nil cache does nothing.
+	var none *diskCache
+	none.put(query, 100, r)
+	_, found = none.get(query, 100)
+	assert.False(t, found)
+}
+
+func TestDiskCachePrune(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "booktastic")
+	defer os.RemoveAll(dir)
+
+	d, _ := newDiskCache(dir, "booktastic", "v1", 0, 1)
+	queries := []map[string]interface{}{
+		{"query": "first"},
+		{"query": "second"},
+	}
+
+	for i, q := range queries {
+		d.put(q, 10, map[string]interface{}{"hits": i})
+		when := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(d.filename(q), when, when)
+	}
+
+	// Too big, so the oldest go first.
+	info, _ := os.Stat(d.filename(queries[1]))
+	d.max = info.Size()
+	d.prune()
+
+	_, found := d.get(queries[0], 10)
+	assert.False(t, found)
+	_, found = d.get(queries[1], 10)
+	assert.True(t, found)
+
+	files := 0
+	filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files++
+		}
+
+		return nil
+	})
+
+	assert.Equal(t, 1, files)
+}
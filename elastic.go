@@ -4,33 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/agnivade/levenshtein"
 	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/patrickmn/go-cache"
-	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-const INDEX = "booktastic"
 const CONFIDENCE = 75
 const HIGHCONFIDENCE = 90
 
-type ElasticQuery struct {
-	Author string
-	Title  string
-}
-
-type ElasticResult struct {
-	Author       string
-	Title        string
-	NormalAuthor string
-	NormalTitle  string
-}
-
-// We use a cache to reduce searches, as our parallelisation can often result in the same combinations.
-var elasticCache *cache.Cache = nil
+// How close two matches have to be for popularity to decide between them.
+const POPULARITY_MARGIN = 5
 
 func removeShortWords(str string) string {
 	words := strings.Split(strings.TrimSpace(str), " ")
@@ -47,35 +38,183 @@ func removeShortWords(str string) string {
 	return strings.Join(ret, " ")
 }
 
-var esConnection *elasticsearch.Client = nil
+func newElasticClient(cfg ElasticConfig) (*elasticsearch.Client, error) {
+	transport, err := cfg.transport()
 
-func getElastic() *elasticsearch.Client {
-	if esConnection == nil {
-		// Get our client.  We need a separate one because we're very parallelised here.
-		cfg := elasticsearch.Config{
-			Addresses: []string{
-				"http://elastic1:9200",
-				"http://elastic2:9200",
-			},
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: cfg.Addresses,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		APIKey:    cfg.APIKey,
+		Transport: transport,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Elasticsearch client: %s", err)
+	}
+
+	return client, nil
+}
+
+// The Elasticsearch implementation of our catalogue.
+type elasticCatalogue struct {
+	// First, so that the counters are aligned for atomic access on 32-bit platforms.
+	stats CatalogueStats
+
+	client    *elasticsearch.Client
+	addresses []string
+	index     string
+	timeout   time.Duration
+	fixture   *elasticFixture
+	batcher   *multiSearcher
+
+	// We use a cache to reduce searches, as our parallelisation can often result in the same combinations.
+	cache *cache.Cache
+
+	// Optionally, we keep results on disk between runs too.
+	disk *diskCache
+
+	flights flightGroup
+}
+
+// Close stops the background work for the catalogue.  Anything which builds many catalogues should close them once
+// they're done with.
+func (c *elasticCatalogue) Close() {
+	if c.batcher != nil {
+		c.batcher.close()
+	}
+}
+
+func newElasticCatalogue(cfg ElasticConfig) (*elasticCatalogue, error) {
+	client, err := newElasticClient(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &elasticCatalogue{
+		client:    client,
+		addresses: cfg.Addresses,
+		index:     cfg.Index,
+		timeout:   cfg.Timeout,
+		cache:     cache.New(cache.NoExpiration, 10*time.Minute),
+	}
+
+	if cfg.Batch > 1 {
+		c.batcher = newMultiSearcher(c, cfg.Batch)
+	}
+
+	if len(cfg.CacheDir) > 0 {
+		version, err := c.indexVersion(context.Background())
+
+		if err != nil {
+			return nil, err
 		}
 
-		esConnection, _ = elasticsearch.NewClient(cfg)
+		if c.disk, err = newDiskCache(cfg.CacheDir, cfg.Index, version, cfg.CacheTTL, int64(cfg.CacheMB)*1024*1024); err != nil {
+			return nil, fmt.Errorf("failed to open cache %s: %s", cfg.CacheDir, err)
+		}
 	}
 
-	return esConnection
+	return c, nil
 }
 
-func getCache() {
-	if elasticCache == nil {
-		sugar.Debugf("Create cache")
-		elasticCache = cache.New(cache.NoExpiration, 10*time.Minute)
+// Something which changes whenever the index is rebuilt.  Recreating the index gives it a new uuid, and loading more
+// into an existing one updates the time in its metadata.  The index might be an alias, so we cover every index it
+// points at.
+func (c *elasticCatalogue) indexVersion(ctx context.Context) (string, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	es := c.client
+
+	var settings map[string]struct {
+		Settings struct {
+			Index struct {
+				UUID string `json:"uuid"`
+			} `json:"index"`
+		} `json:"settings"`
+	}
+
+	res, err := es.Indices.GetSettings(es.Indices.GetSettings.WithContext(ctx), es.Indices.GetSettings.WithIndex(c.index))
+
+	if err := decodeResponse(res, err, &settings); err != nil {
+		return "", err
 	}
+
+	var mappings map[string]struct {
+		Mappings struct {
+			Meta map[string]interface{} `json:"_meta"`
+		} `json:"mappings"`
+	}
+
+	res, err = es.Indices.GetMapping(es.Indices.GetMapping.WithContext(ctx), es.Indices.GetMapping.WithIndex(c.index))
+
+	if err := decodeResponse(res, err, &mappings); err != nil {
+		return "", err
+	}
+
+	names := []string{}
+
+	for name := range settings {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	version := []string{}
+
+	for _, name := range names {
+		version = append(version, fmt.Sprintf("%s:%s:%v", name, settings[name].Settings.Index.UUID, mappings[name].Mappings.Meta["loaded"]))
+	}
+
+	return strings.Join(version, ","), nil
 }
 
-// Queries are executed using channels so that we can perform them in parallel
-func SearchAuthorTitle(spineindex int, author string, title string, origauth string, origtitle string, phaseid int) {
-	// Empirical testing shows that using a fuzziness of 2 for author all the time gives good results.
-	sugar.Debugf("Search author & title %s - %s", author, title)
+func decodeResponse(res *esapi.Response, err error, v interface{}) error {
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("[%s]", res.Status())
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Check that we can actually talk to the cluster, so that a bad config shows up straight away.
+func (c *elasticCatalogue) ping(ctx context.Context) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	res, err := c.client.Info(c.client.Info.WithContext(ctx))
+
+	if err != nil {
+		return fmt.Errorf("failed to connect to Elasticsearch at %s: %s", strings.Join(c.addresses, ", "), err)
+	}
+
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("Elasticsearch at %s returned %s", strings.Join(c.addresses, ", "), res.Status())
+	}
+
+	return nil
+}
+
+func (c *elasticCatalogue) SearchAuthorTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
 			"bool": map[string]interface{}{
@@ -101,13 +240,16 @@ func SearchAuthorTitle(spineindex int, author string, title string, origauth str
 		},
 	}
 
-	r, _ := performCachedSearch(author+"-"+title, query, 5)
-	processElasticResults(r, spineindex, author, title, origauth, origtitle, phaseid)
+	r, _, err := c.performCachedSearch(ctx, author+"-"+title, query, size)
+
+	if err != nil {
+		return []Work{}, err
+	}
+
+	return elasticHits(r)
 }
 
-func SearchAuthor(spineindex int, author string, title string, origauth string, origtitle string, phaseid int, cacheonly bool) map[string]interface{} {
-	// Empirical testing shows that using a fuzziness of 2 for author all the time gives good results.
-	sugar.Debugf("Search author %s - %s", author, title)
+func (c *elasticCatalogue) SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error) {
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
 			"bool": map[string]interface{}{
@@ -131,18 +273,16 @@ func SearchAuthor(spineindex int, author string, title string, origauth string,
 		},
 	}
 
-	r, _ := performCachedSearch(author+"-", query, 100)
+	r, _, err := c.performCachedSearch(ctx, author+"-", query, size)
 
-	if !cacheonly {
-		processElasticResults(r, spineindex, author, title, origauth, origtitle, phaseid)
+	if err != nil {
+		return []Work{}, err
 	}
 
-	return r
+	return elasticHits(r)
 }
 
-func SearchTitle(spineindex int, author string, title string, origauth string, origtitle string, phaseid int) {
-	// Empirical testing shows that using a fuzziness of 2 for author all the time gives good results.
-	sugar.Debugf("Search title %s - %s", author, title)
+func (c *elasticCatalogue) SearchTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
 			"bool": map[string]interface{}{
@@ -166,80 +306,374 @@ func SearchTitle(spineindex int, author string, title string, origauth string, o
 		},
 	}
 
-	r, _ := performCachedSearch("-"+title, query, 100)
-	processElasticResults(r, spineindex, author, title, origauth, origtitle, phaseid)
+	r, _, err := c.performCachedSearch(ctx, "-"+title, query, size)
+
+	if err != nil {
+		return []Work{}, err
+	}
+
+	return elasticHits(r)
 }
 
-func performCachedSearch(key string, query map[string]interface{}, size int) (map[string]interface{}, bool) {
+func (c *elasticCatalogue) WorksByVIAF(ctx context.Context, viafid string, size int) ([]Work, error) {
+	if len(viafid) == 0 {
+		// Not every author has one, and they don't all share the same one.
+		return []Work{}, nil
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match": map[string]interface{}{
+				"viafid": viafid,
+			},
+		},
+	}
+
+	r, _, err := c.performCachedSearch(ctx, viafid+"-", query, size)
+
+	if err != nil {
+		return []Work{}, err
+	}
+
+	return elasticHits(r)
+}
+
+func elasticHits(r map[string]interface{}) ([]Work, error) {
+	works := []Work{}
+	hits, ok := r["hits"].(map[string]interface{})
+
+	if !ok {
+		return works, errors.New("no hits in Elasticsearch response")
+	}
+
+	list, _ := hits["hits"].([]interface{})
+
+	for _, hit := range list {
+		if hit, ok := hit.(map[string]interface{}); ok {
+			sugar.Debugf(" * ID=%s, %s", hit["_id"], hit["_source"])
+
+			if source, ok := hit["_source"].(map[string]interface{}); ok {
+				works = append(works, workFromSource(source))
+			}
+		}
+	}
+
+	return works, nil
+}
+
+// Queries are executed using channels so that we can perform them in parallel
+func (id *Identifier) SearchAuthorTitle(ctx context.Context, spineindex int, author string, title string, origauth string, origtitle string, phaseid int) error {
+	// Empirical testing shows that using a fuzziness of 2 for author all the time gives good results.
+	sugar.Debugf("Search author & title %s - %s", author, title)
+	works, err := id.catalogue.SearchAuthorTitle(ctx, author, title, 5)
+	id.processElasticResults(works, spineindex, author, title, origauth, origtitle, phaseid, MATCH_AUTHOR_TITLE)
+
+	return err
+}
+
+func (id *Identifier) SearchAuthor(ctx context.Context, spineindex int, author string, title string, origauth string, origtitle string, phaseid int) error {
+	sugar.Debugf("Search author %s - %s", author, title)
+	works, err := id.catalogue.SearchAuthor(ctx, author, title, 100)
+	id.processElasticResults(works, spineindex, author, title, origauth, origtitle, phaseid, MATCH_AUTHOR)
+
+	return err
+}
+
+func (id *Identifier) SearchTitle(ctx context.Context, spineindex int, author string, title string, origauth string, origtitle string, phaseid int) error {
+	sugar.Debugf("Search title %s - %s", author, title)
+	works, err := id.catalogue.SearchTitle(ctx, author, title, 100)
+	id.processElasticResults(works, spineindex, author, title, origauth, origtitle, phaseid, MATCH_TITLE)
+
+	return err
+}
+
+// What we keep in the caches.  Another search with the same query can use it if it wants no more results than we
+// asked for, or if we already have all the results there are.
+type cachedSearch struct {
+	Size     int                    `json:"size"`
+	Response map[string]interface{} `json:"response"`
+}
+
+func hitList(r map[string]interface{}) []interface{} {
+	hits, _ := r["hits"].(map[string]interface{})
+	list, _ := hits["hits"].([]interface{})
+	return list
+}
+
+func (s cachedSearch) covers(size int) bool {
+	return s.Size >= size || len(hitList(s.Response)) < s.Size
+}
+
+// The response as though we'd only asked for size results.
+func (s cachedSearch) hits(size int) map[string]interface{} {
+	list := hitList(s.Response)
+
+	if len(list) <= size {
+		return s.Response
+	}
+
+	// Copy rather than change what's in the cache.
+	hits := map[string]interface{}{}
+
+	for k, v := range s.Response["hits"].(map[string]interface{}) {
+		hits[k] = v
+	}
+
+	hits["hits"] = list[:size]
+
+	r := map[string]interface{}{}
+
+	for k, v := range s.Response {
+		r[k] = v
+	}
+
+	r["hits"] = hits
+
+	return r
+}
+
+// Searches are cached on the whole query.  Maps marshal with sorted keys, so the same query always gives the same key.
+func searchKey(query map[string]interface{}) string {
+	key, _ := json.Marshal(query)
+	return string(key)
+}
+
+// A key for exactly this search, size and all.
+func sizedKey(key string, size int) string {
+	return strconv.Itoa(size) + " " + key
+}
+
+func (c *elasticCatalogue) remember(key string, size int, r map[string]interface{}) {
+	if x, found := c.cache.Get(key); found && x.(cachedSearch).Size >= size {
+		return
+	}
+
+	c.cache.Set(key, cachedSearch{
+		Size:     size,
+		Response: r,
+	}, cache.NoExpiration)
+}
+
+// The name is just for logging.
+func (c *elasticCatalogue) performCachedSearch(ctx context.Context, name string, query map[string]interface{}, size int) (map[string]interface{}, bool, error) {
 	var r map[string]interface{}
+	key := searchKey(query)
 
 	// See if we have an entry cached which will save the query.
-	getCache()
-
 	var cached bool
 
-	if x, found := elasticCache.Get(key); found {
-		sugar.Debugf("Found cache entry %s", key)
-		r = x.(map[string]interface{})
+	if x, found := c.cache.Get(key); found && x.(cachedSearch).covers(size) {
+		sugar.Debugf("Found cache entry %s", name)
+		atomic.AddInt64(&c.stats.Hits, 1)
+		r = x.(cachedSearch).hits(size)
 		cached = true
-	} else {
-		// No cache entry - query.
+	} else if c.fixture != nil && !c.fixture.record {
+		// Replaying - we must never touch the network.
 		cached = false
-		sugar.Debugf("ELASTIC: %s", key)
-		es := getElastic()
+		var found bool
 
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(query); err != nil {
-			log.Fatalf("Error encoding query: %s", err)
+		if r, found = c.fixture.get(sizedKey(key, size)); !found {
+			// The fixture is out of date with respect to the code, and needs recording again.  Finding nothing would
+			// look like a worse result rather than a stale fixture.
+			return nil, false, fmt.Errorf("no fixture entry for %s in %s", name, c.fixture.filename)
 		}
 
-		// Perform the search request.
-		res, err := es.Search(
-			es.Search.WithContext(context.Background()),
-			es.Search.WithIndex(INDEX),
-			es.Search.WithBody(&buf),
-			//es.Search.WithPretty(),
-			es.Search.WithSize(size),
-		)
+		c.remember(key, size, r)
+	} else {
+		// The cache is only filled once a search returns, so other searches may be asking for the same thing right
+		// now.  If so we wait for theirs rather than sending it again.
+		var shared bool
+		var err error
+
+		r, shared, err = c.flights.do(ctx, sizedKey(key, size), func() (map[string]interface{}, error) {
+			return c.fetch(ctx, name, key, query, size)
+		})
 
 		if err != nil {
-			log.Fatalf("Error getting response: %s", err)
+			return nil, false, err
 		}
 
-		defer res.Body.Close()
+		if shared {
+			sugar.Debugf("Shared search %s", name)
+			atomic.AddInt64(&c.stats.Coalesced, 1)
+		}
 
-		if res.IsError() {
-			var e map[string]interface{}
-			if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
-				log.Fatalf("Error parsing the response body: %s", err)
-			} else {
-				// Print the response status and error information.
-				log.Fatalf("[%s] %s: %s",
-					res.Status(),
-					e["error"].(map[string]interface{})["type"],
-					e["error"].(map[string]interface{})["reason"],
-				)
+		cached = shared
+	}
+
+	if c.fixture != nil && c.fixture.record {
+		// Record cache hits too, as the cache might have been filled by a different run.
+		c.fixture.put(sizedKey(key, size), r)
+	}
+
+	return r, cached, nil
+}
+
+// Get a search which isn't in the memory cache, from the disk cache if we can and Elasticsearch if not.
+func (c *elasticCatalogue) fetch(ctx context.Context, name string, key string, query map[string]interface{}, size int) (map[string]interface{}, error) {
+	if r, found := c.disk.get(query, size); found {
+		sugar.Debugf("Found disk cache entry %s", name)
+		atomic.AddInt64(&c.stats.DiskHits, 1)
+		c.remember(key, size, r)
+		return r, nil
+	}
+
+	// No cache entry - query.
+	sugar.Debugf("ELASTIC: %s", name)
+	atomic.AddInt64(&c.stats.Misses, 1)
+
+	var r map[string]interface{}
+	var err error
+
+	if c.batcher != nil {
+		r, err = c.batcher.search(ctx, name, query, size)
+	} else {
+		r, err = c.search(ctx, name, query, size)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Save in cache for next time.
+	sugar.Debugf("ELASTIC: %s returned %+v", name, r)
+	c.remember(key, size, r)
+	c.disk.put(query, size, r)
+
+	return r, nil
+}
+
+// CatalogueStats counts how our searches were answered.
+type CatalogueStats struct {
+	Hits      int64 `json:"hits"`      // From the memory cache
+	DiskHits  int64 `json:"diskhits"`  // From the disk cache
+	Misses    int64 `json:"misses"`    // Sent to Elasticsearch
+	Coalesced int64 `json:"coalesced"` // Waited for the same search from someone else
+}
+
+func (c *elasticCatalogue) Stats() CatalogueStats {
+	return CatalogueStats{
+		Hits:      atomic.LoadInt64(&c.stats.Hits),
+		DiskHits:  atomic.LoadInt64(&c.stats.DiskHits),
+		Misses:    atomic.LoadInt64(&c.stats.Misses),
+		Coalesced: atomic.LoadInt64(&c.stats.Coalesced),
+	}
+}
+
+// How hard we try when a search fails for a reason which might go away (timeouts, an overloaded cluster).  The
+// backoff doubles on each retry.
+const ELASTIC_RETRIES = 4
+const ELASTIC_BACKOFF = 250 * time.Millisecond
+
+// An error from a search.  Transient ones are worth retrying.
+type elasticError struct {
+	transient bool
+	err       error
+}
+
+func (e *elasticError) Error() string {
+	return e.err.Error()
+}
+
+func (c *elasticCatalogue) search(ctx context.Context, key string, query map[string]interface{}, size int) (map[string]interface{}, error) {
+	body, err := json.Marshal(query)
+
+	if err != nil {
+		return nil, fmt.Errorf("error encoding query %s: %s", key, err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		r, err := c.searchOnce(ctx, body, size)
+
+		if err == nil {
+			return r, nil
+		}
+
+		if ctx.Err() != nil {
+			// We've run out of time, or been cancelled - that's not the search's fault.
+			return nil, ctx.Err()
+		}
+
+		if e, ok := err.(*elasticError); !ok || !e.transient || attempt >= ELASTIC_RETRIES {
+			return nil, fmt.Errorf("search %s failed after %d attempts: %s", key, attempt+1, err)
+		}
+
+		backoff := ELASTIC_BACKOFF << uint(attempt)
+		sugar.Warnf("Search %s failed, retry in %v: %s", key, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *elasticCatalogue) searchOnce(ctx context.Context, body []byte, size int) (map[string]interface{}, error) {
+	es := c.client
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	// Perform the search request.
+	res, err := es.Search(
+		es.Search.WithContext(ctx),
+		es.Search.WithIndex(c.index),
+		es.Search.WithBody(bytes.NewReader(body)),
+		//es.Search.WithPretty(),
+		es.Search.WithSize(size),
+	)
+
+	if err != nil {
+		return nil, &elasticError{
+			transient: true,
+			err:       fmt.Errorf("error getting response: %s", err),
+		}
+	}
+
+	defer res.Body.Close()
+
+	if res.IsError() {
+		// Too many requests, or something wrong at the server end, might well work next time.
+		transient := res.StatusCode == 429 || res.StatusCode >= 500
+		var e map[string]interface{}
+
+		if err := json.NewDecoder(res.Body).Decode(&e); err == nil {
+			if detail, ok := e["error"].(map[string]interface{}); ok {
+				return nil, &elasticError{
+					transient: transient,
+					err:       fmt.Errorf("[%s] %s: %s", res.Status(), detail["type"], detail["reason"]),
+				}
 			}
 		}
 
-		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-			log.Fatalf("Error parsing the response body: %s", err)
+		return nil, &elasticError{
+			transient: transient,
+			err:       fmt.Errorf("[%s]", res.Status()),
 		}
+	}
+
+	var r map[string]interface{}
 
-		// Save in cache for next time.
-		sugar.Debugf("ELASTIC: %s returned %+v", key, r)
-		elasticCache.Set(key, r, cache.NoExpiration)
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, &elasticError{
+			transient: true,
+			err:       fmt.Errorf("error parsing the response body: %s", err),
+		}
 	}
 
-	return r, cached
+	return r, nil
 }
 
-func processElasticResults(r map[string]interface{}, spineindex int, author string, title string, origauth string, origtitle string, phaseid int) {
-	for _, hit := range r["hits"].(map[string]interface{})["hits"].([]interface{}) {
-		sugar.Debugf(" * ID=%s, %s", hit.(map[string]interface{})["_id"], hit.(map[string]interface{})["_source"])
-		data := hit.(map[string]interface{})["_source"]
-		hitauthor := fmt.Sprintf("%v", data.(map[string]interface{})["normalauthor"])
-		hittitle := fmt.Sprintf("%v", data.(map[string]interface{})["normaltitle"])
+func (id *Identifier) processElasticResults(works []Work, spineindex int, author string, title string, origauth string, origtitle string, phaseid int, strategy int) {
+	matches := []searchResult{}
+
+	for _, work := range works {
+		hitauthor := work.NormalAuthor
+		hittitle := work.NormalTitle
 
 		if len(hitauthor) > 0 && len(hittitle) > 0 {
 			authperc := compare(author, hitauthor)
@@ -247,21 +681,59 @@ func processElasticResults(r map[string]interface{}, spineindex int, author stri
 
 			sugar.Debugf("Author + title match %d, %d, %s - %s vs %s - %s", authperc, titperc, author, title, hitauthor, hittitle)
 			if authperc >= CONFIDENCE && titperc >= CONFIDENCE && sanityCheck(hitauthor, hittitle) {
-				sugar.Debugf("FOUND: in spine %d match %d, %d %+v", spineindex, authperc, titperc, data)
+				sugar.Debugf("FOUND: in spine %d match %d, %d %+v", spineindex, authperc, titperc, work)
 
-				// Pass out the result.
-				addResult(searchResult{
+				matches = append(matches, searchResult{
 					phaseid:      phaseid,
 					spineindex:   spineindex,
+					firstspine:   spineindex,
 					searchAuthor: origauth,
 					searchTitle:  origtitle,
-					foundAuthor:  fmt.Sprintf("%v", data.(map[string]interface{})["author"]),
-					foundTitle:   fmt.Sprintf("%v", data.(map[string]interface{})["title"]),
-					foundVIAF:    fmt.Sprintf("%v", data.(map[string]interface{})["viafid"]),
+					foundAuthor:  work.Author,
+					foundTitle:   work.Title,
+					foundVIAF:    work.VIAF,
+					authorScore:  authperc,
+					titleScore:   titperc,
+					strategy:     strategy,
+					popularity:   work.Popularity,
 				})
 			}
 		}
 	}
+
+	// Pass out the results.  The first one identifies the spine.
+	for _, match := range preferPopular(matches) {
+		id.addResult(match)
+	}
+}
+
+// Among the matches which are about as good as the best one, put the better known works first.  Fuzzy matching
+// against a big catalogue finds plenty of obscure works which just happen to look like the text on the spine.
+func preferPopular(matches []searchResult) []searchResult {
+	best := 0
+
+	for _, match := range matches {
+		if match.score() > best {
+			best = match.score()
+		}
+	}
+
+	near := []searchResult{}
+	rest := []searchResult{}
+
+	for _, match := range matches {
+		if match.score() >= best-POPULARITY_MARGIN {
+			near = append(near, match)
+		} else {
+			rest = append(rest, match)
+		}
+	}
+
+	sort.SliceStable(near, func(a, b int) bool {
+		return near[a].popularity > near[b].popularity
+	})
+
+	return append(near, rest...)
 }
 
 func sanityCheck(author, title string) bool {
@@ -308,7 +780,7 @@ func compare(str1, str2 string) int {
 	return pc
 }
 
-func search(spineindex int, author string, title string, authorplustitle bool, phaseid int) {
+func (id *Identifier) search(ctx context.Context, spineindex int, author string, title string, authorplustitle bool, phaseid int) error {
 	// We need to keep the original values for the result, though we search on the normalised values.
 	origauth := author
 	origtitle := title
@@ -331,13 +803,13 @@ func search(spineindex int, author string, title string, authorplustitle bool, p
 	// cuts down combinations.
 	if !oklen || len(authwords) > 3 {
 		sugar.Debugf("Reject length author %s", author)
-		return
+		return nil
 	}
 
 	// There are some titles which are very short, but they are more likely to just be false junk.
 	if len(title) < 4 {
 		sugar.Debugf("Reject too short title %s", title)
-		return
+		return nil
 	}
 
 	// No point searching for empty author/title.
@@ -347,18 +819,23 @@ func search(spineindex int, author string, title string, authorplustitle bool, p
 	if len(author) > 0 && len(title) > 0 && (strings.ContainsRune(author, ' ') || strings.ContainsRune(title, ' ')) {
 		if authorplustitle {
 			sugar.Debugf("author - title")
-			SearchAuthorTitle(spineindex, author, title, origauth, origtitle, phaseid)
+			return id.SearchAuthorTitle(ctx, spineindex, author, title, origauth, origtitle, phaseid)
 		} else {
 			sugar.Debugf("author only")
-			SearchAuthor(spineindex, author, title, origauth, origtitle, phaseid, false)
+
+			if err := id.SearchAuthor(ctx, spineindex, author, title, origauth, origtitle, phaseid); err != nil {
+				return err
+			}
 
 			// Timing windows - might already have identified.
-			if !checkResult(spineindex) {
+			if !id.checkResult(spineindex) {
 				sugar.Debugf("title only")
-				SearchTitle(spineindex, author, title, origauth, origtitle, phaseid)
+				return id.SearchTitle(ctx, spineindex, author, title, origauth, origtitle, phaseid)
 			} else {
 				sugar.Debugf("Already identified %d, skip search", spineindex)
 			}
 		}
 	}
+
+	return nil
 }
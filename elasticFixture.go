@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/patrickmn/go-cache"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// A fixture holds the Elasticsearch responses for a run, keyed on the query and size.  In record mode
+// we save every response we use, so that the run can later be replayed with no cluster at all.
+type elasticFixture struct {
+	filename  string
+	record    bool
+	mux       sync.Mutex
+	responses map[string]map[string]interface{}
+}
+
+func newElasticFixture(filename string, record bool) (*elasticFixture, error) {
+	f := &elasticFixture{
+		filename:  filename,
+		record:    record,
+		responses: map[string]map[string]interface{}{},
+	}
+
+	if !record {
+		data, err := ioutil.ReadFile(filename)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(data, &f.responses); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (f *elasticFixture) get(key string) (map[string]interface{}, bool) {
+	f.mux.Lock()
+	r, found := f.responses[key]
+	f.mux.Unlock()
+
+	return r, found
+}
+
+func (f *elasticFixture) put(key string, r map[string]interface{}) {
+	f.mux.Lock()
+	f.responses[key] = r
+	f.mux.Unlock()
+}
+
+// Save writes out what we've recorded.  Keys are sorted by the encoder so that re-recording gives a sensible diff.
+func (f *elasticFixture) Save() error {
+	if !f.record {
+		return nil
+	}
+
+	f.mux.Lock()
+	encoded, err := json.MarshalIndent(f.responses, "", " ")
+	f.mux.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(f.filename, encoded, 0644)
+}
+
+// A catalogue which records to or replays from a fixture file.  Replaying doesn't need a client, so the config is
+// only used when recording.
+func newElasticFixtureCatalogue(filename string, record bool, cfg ElasticConfig) (*elasticCatalogue, error) {
+	fixture, err := newElasticFixture(filename, record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if record {
+		c, err := newElasticCatalogue(cfg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.fixture = fixture
+
+		return c, nil
+	}
+
+	return &elasticCatalogue{
+		fixture: fixture,
+		cache:   cache.New(cache.NoExpiration, 10*time.Minute),
+	}, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestElasticFixture(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "booktastic")
+	defer os.RemoveAll(dir)
+	ffn := filepath.Join(dir, "test.es.json")
+
+	// Record against a fake cluster.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"hits": {"hits": [{"_id": "1", "_source": {"author": "Edward Marston", "title": "Dance of Death", "normalauthor": "edward marston", "normaltitle": "dance death", "viafid": 12345}}]}}`)
+	}))
+
+	cfg := defaultElasticConfig()
+	cfg.Addresses = []string{server.URL}
+	cfg.Batch = 1
+
+	recorder, err := newElasticFixtureCatalogue(ffn, true, cfg)
+	assert.Nil(t, err)
+	_, err = recorder.SearchAuthor(context.Background(), "edward marston", "dance death", 100)
+	assert.Nil(t, err)
+	assert.Nil(t, recorder.fixture.Save())
+	server.Close()
+
+	_, err = newElasticFixtureCatalogue(filepath.Join(dir, "missing.es.json"), false, defaultElasticConfig())
+	assert.NotNil(t, err)
+
+	c, err := newElasticFixtureCatalogue(ffn, false, defaultElasticConfig())
+	assert.Nil(t, err)
+	assert.Nil(t, c.client)
+
+	works, _ := c.SearchAuthor(context.Background(), "edward marston", "dance death", 100)
+	assert.Equal(t, 1, len(works))
+	assert.Equal(t, "Dance of Death", works[0].Title)
+	assert.Equal(t, "12345", works[0].VIAF)
+
+	// Not recorded, so the fixture is stale - which is an error rather than nothing found, and no network either.
+	works, err = c.SearchTitle(context.Background(), "", "deeds darkness", 100)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(works))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testElasticCatalogue(t *testing.T, handler http.HandlerFunc) (*elasticCatalogue, func()) {
+	server := httptest.NewServer(handler)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses:    []string{server.URL},
+		DisableRetry: true,
+	})
+	assert.Nil(t, err)
+
+	return &elasticCatalogue{
+		client: client,
+		index:  "booktastic",
+		cache:  cache.New(cache.NoExpiration, 10*time.Minute),
+	}, server.Close
+}
+
+func TestElasticRetry(t *testing.T) {
+	calls := 0
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error": {"type": "es_rejected_execution_exception", "reason": "busy"}}`))
+		} else {
+			_, _ = w.Write([]byte(`{"hits": {"hits": [{"_source": {"author": "Iris Murdoch", "title": "The Sea, the Sea", "viafid": "1"}}]}}`))
+		}
+	})
+	defer done()
+
+	r, err := c.search(context.Background(), "retry", map[string]interface{}{}, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	works, err := elasticHits(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "Iris Murdoch", works[0].Author)
+}
+
+func TestElasticPermanentError(t *testing.T) {
+	calls := 0
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": {"type": "parsing_exception", "reason": "bad query"}}`))
+	})
+	defer done()
+
+	_, err := c.search(context.Background(), "bad", map[string]interface{}{}, 5)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad query")
+	assert.Equal(t, 1, calls)
+}
+
+func TestMultiSearch(t *testing.T) {
+	var mux sync.Mutex
+	msearches := 0
+
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		assert.True(t, strings.HasSuffix(r.URL.Path, "/_msearch"))
+		msearches++
+
+		// Echo back the size we asked for in each search, apart from one which fails.
+		responses := []interface{}{}
+		scanner := bufio.NewScanner(r.Body)
+
+		for scanner.Scan() {
+			scanner.Scan()
+			var body map[string]interface{}
+			_ = json.Unmarshal(scanner.Bytes(), &body)
+
+			if body["size"].(float64) == 2 {
+				responses = append(responses, map[string]interface{}{
+					"status": 400,
+					"error":  map[string]interface{}{"type": "parsing_exception"},
+				})
+			} else {
+				responses = append(responses, map[string]interface{}{
+					"hits": map[string]interface{}{
+						"hits": []interface{}{
+							map[string]interface{}{"_source": map[string]interface{}{"title": fmt.Sprintf("%v", body["size"])}},
+						},
+					},
+				})
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	})
+	defer done()
+
+	m := newMultiSearcher(c, 10)
+	m.window = 100 * time.Millisecond
+
+	var wg sync.WaitGroup
+	titles := make([]string, 3)
+	errs := make([]error, 3)
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := m.search(context.Background(), fmt.Sprintf("key%d", i), map[string]interface{}{}, i+1)
+			errs[i] = err
+
+			if err == nil {
+				works, _ := elasticHits(r)
+				titles[i] = works[0].Title
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	assert.Equal(t, 1, msearches)
+	assert.Equal(t, "1", titles[0])
+	assert.NotNil(t, errs[1])
+	assert.Equal(t, "3", titles[2])
+}
+
+func TestMultiSearchClose(t *testing.T) {
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer done()
+
+	c.batcher = newMultiSearcher(c, 10)
+	m := c.batcher
+	stopped := make(chan struct{})
+
+	m.once.Do(func() {
+		go func() {
+			m.collect()
+			close(stopped)
+		}()
+	})
+
+	c.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Collector still running")
+	}
+
+	_, err := m.search(context.Background(), "key", map[string]interface{}{}, 1)
+	assert.Equal(t, errSearcherClosed, err)
+
+	// Closing twice is fine.
+	c.Close()
+}
+
+func TestMultiSearchCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_msearch") {
+			return
+		}
+
+		// The server only notices the client going away once it's read the request.
+		_, _ = ioutil.ReadAll(r.Body)
+		started <- struct{}{}
+
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer done()
+
+	m := newMultiSearcher(c, 10)
+	m.window = 50 * time.Millisecond
+	defer m.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := m.search(ctx, fmt.Sprintf("key%d", i), map[string]interface{}{}, i+1)
+			assert.NotNil(t, err)
+		}(i)
+	}
+
+	<-started
+	cancel()
+	wg.Wait()
+
+	// Everyone waiting has given up, so the batch should be too.
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Multi search still running")
+	}
+}
+
+func TestIndexVersion(t *testing.T) {
+	uuid := "first"
+
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// The index is an alias for the real one.
+		if strings.HasSuffix(r.URL.Path, "/_settings") {
+			fmt.Fprintf(w, `{"booktastic_1": {"settings": {"index": {"uuid": "%s"}}}}`, uuid)
+		} else {
+			fmt.Fprint(w, `{"booktastic_1": {"mappings": {"_meta": {"loaded": "2020-06-01T00:00:00Z"}}}}`)
+		}
+	})
+	defer done()
+
+	v1, err := c.indexVersion(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "booktastic_1:first:2020-06-01T00:00:00Z", v1)
+
+	// Recreated.
+	uuid = "second"
+	v2, err := c.indexVersion(context.Background())
+	assert.Nil(t, err)
+	assert.NotEqual(t, v1, v2)
+}
+
+func TestCoalescedSearches(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"hits": {"hits": [{"_source": {"author": "Edward Marston", "title": "Dance of Death"}}]}}`)
+	})
+	defer done()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			works, err := c.SearchAuthor(context.Background(), "edward marston", "dance death", 100)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(works))
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// And now it's cached.
+	_, _ = c.SearchAuthor(context.Background(), "edward marston", "dance death", 100)
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+	assert.Equal(t, CatalogueStats{Hits: 1, Misses: 1, Coalesced: 4}, c.Stats())
+}
+
+func TestCacheSizes(t *testing.T) {
+	var calls int64
+
+	c, done := testElasticCatalogue(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		hits := []string{}
+
+		for i := 0; i < 5; i++ {
+			hits = append(hits, fmt.Sprintf(`{"_source": {"author": "Edward Marston", "title": "Book %d"}}`, i))
+		}
+
+		fmt.Fprintf(w, `{"hits": {"hits": [%s]}}`, strings.Join(hits, ","))
+	})
+	defer done()
+
+	ctx := context.Background()
+
+	// Five hits for five asked - there might be more.
+	works, _ := c.WorksByVIAF(ctx, "12345", 5)
+	assert.Equal(t, 5, len(works))
+	works, _ = c.WorksByVIAF(ctx, "12345", 500)
+	assert.Equal(t, 5, len(works))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+
+	// Now we know there are only five, so anything can use it.
+	works, _ = c.WorksByVIAF(ctx, "12345", 1000)
+	assert.Equal(t, 5, len(works))
+	works, _ = c.WorksByVIAF(ctx, "12345", 2)
+	assert.Equal(t, 2, len(works))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+
+	// A different title is a different query.
+	_, _ = c.SearchAuthor(ctx, "edward marston", "dance death", 100)
+	_, _ = c.SearchAuthor(ctx, "edward marston", "deeds darkness", 100)
+	assert.Equal(t, int64(4), atomic.LoadInt64(&calls))
+}
+
+func TestPreferPopular(t *testing.T) {
+	matches := []searchResult{
+		{foundTitle: "Obscure", authorScore: 90, titleScore: 90, popularity: 1},
+		{foundTitle: "Famous", authorScore: 88, titleScore: 88, popularity: 50},
+		{foundTitle: "Worse", authorScore: 70, titleScore: 70, popularity: 500},
+	}
+
+	// Close scores go by popularity, but popularity doesn't rescue a much worse match.
+	titles := []string{}
+
+	for _, match := range preferPopular(matches) {
+		titles = append(titles, match.foundTitle)
+	}
+
+	assert.Equal(t, []string{"Famous", "Obscure", "Worse"}, titles)
+}
@@ -16,6 +16,10 @@ type OCRFragment struct {
 	BoundingPoly BoundingPoly `json:"boundingPoly"`
 	SpineIndex   int          `json:"spineindex"`
 	Used         bool         `json:"used"`
+	Shelf        int          `json:"shelf"`
+	Orientation  Orientation  `json:"orientation"`
+	Block        int          `json:"block"`      // Which block of text Google put it in, from 1, or 0 if we don't know
+	Confidence   float64      `json:"confidence"` // How sure Google is of the word, or 0 if it didn't say
 }
 
 type BoundingPoly struct {
@@ -32,13 +36,54 @@ type Spine struct {
 	Author string `json:"author"` // Identified author
 	Title  string `json:"title"`  // Identified subject
 	VIAF   string `json:"viaf"`   // Unique id for author
+
+	Shelf    int `json:"shelf"`    // Which shelf in the photo, from the top
+	Position int `json:"position"` // Left to right along the shelf
+
+	Confidence int         `json:"confidence,omitempty"` // How sure we are of the identification, 0-100
+	Candidates []Candidate `json:"candidates,omitempty"` // Other possibilities, best first
+}
+
+// A Candidate is one possible identification of a spine.
+type Candidate struct {
+	Author     string `json:"author"`
+	Title      string `json:"title"`
+	VIAF       string `json:"viaf"`
+	Confidence int    `json:"confidence"`
+	Popularity int    `json:"popularity,omitempty"`
 }
 
+// GetLinesAndFragments parses the OCR.  That's either the textAnnotations array on its own, or the whole response from
+// Google, in which case we use the fullTextAnnotation if there is one.
 func GetLinesAndFragments(str string) ([]string, []OCRFragment) {
-	// TODO Need default values of X and Y as Google omits if 0.
-	var m []OCRFragment
-	json.Unmarshal([]byte(str), &m)
+	var lines []string
+	var fragments []OCRFragment
+
+	if strings.HasPrefix(strings.TrimSpace(str), "{") {
+		lines, fragments = responseLinesAndFragments(str)
+	} else {
+		var m []OCRFragment
+		json.Unmarshal([]byte(str), &m)
+		lines, fragments = annotationLinesAndFragments(m)
+	}
+
+	for i := range fragments {
+		fragments[i].Used = false
+
+		poly, ok := fragments[i].BoundingPoly.Normalise()
+		fragments[i].BoundingPoly = poly
+
+		if !ok {
+			sugar.Debugf("No usable position for %s", fragments[i].Description)
+		}
+
+		fragments[i].Orientation, _ = FragmentOrientation(fragments[i].BoundingPoly)
+	}
 
+	return lines, fragments
+}
+
+func annotationLinesAndFragments(m []OCRFragment) ([]string, []OCRFragment) {
 	// First entry is a summary, with newline separators for related text.
 	summary := ""
 
@@ -54,16 +99,18 @@ func GetLinesAndFragments(str string) ([]string, []OCRFragment) {
 
 	if len(m) > 1 {
 		fragments = m[1:]
-		for _, f := range fragments {
-			f.Used = false
-		}
 	}
 
 	return lines, fragments
 }
 
+// MaxDimension is roughly the letter height, or 0 if we don't know where the text is.
 func MaxDimension(poly BoundingPoly) int {
-	vertices := poly.Vertices
+	vertices := poly.corners()
+
+	if vertices == nil {
+		return 0
+	}
 
 	x := math.Abs(float64(vertices[0].X) - float64(vertices[3].X))
 	y := math.Abs(float64(vertices[0].Y) - float64(vertices[3].Y))
@@ -195,10 +242,20 @@ func ExtractSpines(lines []string, fragments []OCRFragment) ([]Spine, []OCRFragm
 		cleaned := CleanOCR(line)
 
 		if len(cleaned) > 0 {
+			shelf := 0
+
+			for _, frag := range fragments {
+				if frag.SpineIndex == len(spines) {
+					shelf = frag.Shelf
+					break
+				}
+			}
+
 			spines = append(spines, Spine{
 				Spine:  cleaned,
 				Author: "",
 				Title:  "",
+				Shelf:  shelf,
 			})
 		} else {
 			// We're removing this spine.  Remove any fragments with this spine index.
@@ -206,7 +263,7 @@ func ExtractSpines(lines []string, fragments []OCRFragment) ([]Spine, []OCRFragm
 		}
 	}
 
-	return spines, fragments
+	return numberSpines(spines), fragments
 }
 
 func removeFragmentsForSpine(spineindex int, fragments []OCRFragment) []OCRFragment {
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// A flightGroup makes sure that only one of a set of identical searches is in progress at a time.  Anyone else who
+// asks for the same key while it is gets its result, rather than searching again.
+type flightGroup struct {
+	mux     sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	r    map[string]interface{}
+	err  error
+}
+
+// Returns whether the result came from someone else's search.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (map[string]interface{}, error)) (map[string]interface{}, bool, error) {
+	for {
+		g.mux.Lock()
+
+		if g.flights == nil {
+			g.flights = map[string]*flight{}
+		}
+
+		if f, ok := g.flights[key]; ok {
+			g.mux.Unlock()
+
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+
+			if f.err != nil && ctx.Err() == nil && (f.err == context.Canceled || f.err == context.DeadlineExceeded) {
+				// Whoever did the search gave up, but we haven't.  Try again.
+				continue
+			}
+
+			return f.r, true, f.err
+		}
+
+		f := &flight{
+			done: make(chan struct{}),
+		}
+
+		g.flights[key] = f
+		g.mux.Unlock()
+
+		f.r, f.err = fn()
+
+		g.mux.Lock()
+		delete(g.flights, key)
+		g.mux.Unlock()
+		close(f.done)
+
+		return f.r, false, f.err
+	}
+}
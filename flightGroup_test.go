@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls int64
+	release := make(chan struct{})
+
+	fn := func() (map[string]interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return map[string]interface{}{"hits": 1}, nil
+	}
+
+	var wg sync.WaitGroup
+	var shared int64
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			r, s, err := g.do(context.Background(), "edward marston-", fn)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, r["hits"])
+
+			if s {
+				atomic.AddInt64(&shared, 1)
+			}
+		}()
+	}
+
+	// Give them all time to join the search before it completes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), calls)
+	assert.Equal(t, int64(9), shared)
+
+	// Once finished, the next one searches again.
+	_, s, _ := g.do(context.Background(), "edward marston-", fn)
+	assert.False(t, s)
+	assert.Equal(t, int64(2), calls)
+
+	// Errors are shared too.
+	_, _, err := g.do(context.Background(), "-dance death", func() (map[string]interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	assert.NotNil(t, err)
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+
+	go g.do(leaderCtx, "key", func() (map[string]interface{}, error) {
+		close(started)
+		<-leaderCtx.Done()
+		return nil, leaderCtx.Err()
+	})
+
+	<-started
+
+	// The first search gives up, but we haven't, so we do our own.
+	done := make(chan bool)
+
+	go func() {
+		r, _, err := g.do(context.Background(), "key", func() (map[string]interface{}, error) {
+			return map[string]interface{}{"hits": 2}, nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, r["hits"])
+		done <- true
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Words Google is less sure of than this are usually wood grain, shadows or the pattern on a spine rather than text.
+const OCR_MIN_CONFIDENCE = 0.3
+
+// Words Google is at least this sure of are certainly text.  Below it we're less willing to let a word join up spines.
+const OCR_SURE_CONFIDENCE = 0.8
+
+// The whole response from Google.  It might be wrapped up as one of a batch.
+type annotateResponse struct {
+	Responses          []annotateResponse  `json:"responses"`
+	TextAnnotations    []OCRFragment       `json:"textAnnotations"`
+	FullTextAnnotation *fullTextAnnotation `json:"fullTextAnnotation"`
+}
+
+// The fullTextAnnotation is the same text as the textAnnotations, but arranged into pages, blocks, paragraphs, words
+// and symbols, with how sure Google is of each and where it thinks the lines break.
+type fullTextAnnotation struct {
+	Pages []textPage `json:"pages"`
+	Text  string     `json:"text"`
+}
+
+type textPage struct {
+	Blocks []textBlock `json:"blocks"`
+}
+
+type textBlock struct {
+	Paragraphs []textParagraph `json:"paragraphs"`
+}
+
+type textParagraph struct {
+	Words []textWord `json:"words"`
+}
+
+type textWord struct {
+	BoundingBox BoundingPoly `json:"boundingBox"`
+	Symbols     []textSymbol `json:"symbols"`
+	Confidence  float64      `json:"confidence"`
+}
+
+type textSymbol struct {
+	Text     string       `json:"text"`
+	Property textProperty `json:"property"`
+}
+
+type textProperty struct {
+	DetectedBreak struct {
+		Type string `json:"type"`
+	} `json:"detectedBreak"`
+}
+
+func responseLinesAndFragments(str string) ([]string, []OCRFragment) {
+	var response annotateResponse
+	json.Unmarshal([]byte(str), &response)
+
+	if len(response.Responses) > 0 {
+		response = response.Responses[0]
+	}
+
+	if response.FullTextAnnotation != nil {
+		return fullTextLinesAndFragments(*response.FullTextAnnotation)
+	}
+
+	return annotationLinesAndFragments(response.TextAnnotations)
+}
+
+// Build the lines and fragments from the hierarchy.  A block of text is usually one spine, or a few side by side, and
+// Google rarely splits one spine across blocks, so we always start a new line with a new block, and remember the block
+// so that segmentation doesn't join words across one.  Within a block we break lines where Google saw them break,
+// except that a word hyphenated at the end of a line is one word, covering both halves.
+func fullTextLinesAndFragments(full fullTextAnnotation) ([]string, []OCRFragment) {
+	lines := []string{}
+	fragments := []OCRFragment{}
+	block := 0
+
+	for _, page := range full.Pages {
+		for _, b := range page.Blocks {
+			block++
+			line := []string{}
+			var carry *OCRFragment
+
+			endLine := func() {
+				if len(line) > 0 {
+					lines = append(lines, strings.Join(line, " "))
+					line = []string{}
+				}
+			}
+
+			addWord := func(fragment OCRFragment) {
+				if fragment.Confidence > 0 && fragment.Confidence < OCR_MIN_CONFIDENCE {
+					sugar.Debugf("Ignore %s with confidence %f", fragment.Description, fragment.Confidence)
+				} else if len(fragment.Description) > 0 && !strings.Contains(fragment.Description, " ") {
+					line = append(line, fragment.Description)
+					fragment.SpineIndex = len(lines)
+					fragments = append(fragments, fragment)
+				}
+			}
+
+			for _, paragraph := range b.Paragraphs {
+				for _, word := range paragraph.Words {
+					fragment := OCRFragment{
+						BoundingPoly: word.BoundingBox,
+						Block:        block,
+						Confidence:   word.Confidence,
+					}
+
+					breaktype := ""
+
+					for _, symbol := range word.Symbols {
+						fragment.Description += symbol.Text
+						breaktype = symbol.Property.DetectedBreak.Type
+					}
+
+					fragment.Description = strings.TrimSpace(fragment.Description)
+
+					if carry != nil {
+						// The rest of a hyphenated word.  We're only as sure of it as of the less certain half.
+						carry.Description += fragment.Description
+						carry.BoundingPoly = mergePolys(carry.BoundingPoly, fragment.BoundingPoly)
+
+						if fragment.Confidence > 0 && (carry.Confidence == 0 || fragment.Confidence < carry.Confidence) {
+							carry.Confidence = fragment.Confidence
+						}
+
+						fragment = *carry
+						carry = nil
+					}
+
+					switch breaktype {
+					case "HYPHEN":
+						carry = &fragment
+					case "EOL_SURE_SPACE", "LINE_BREAK":
+						addWord(fragment)
+						endLine()
+					default:
+						addWord(fragment)
+					}
+				}
+			}
+
+			if carry != nil {
+				addWord(*carry)
+			}
+
+			endLine()
+		}
+	}
+
+	sugar.Debugf("Full text %d blocks, %d lines, %d words", block, len(lines), len(fragments))
+
+	return lines, fragments
+}
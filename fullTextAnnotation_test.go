@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Two spines next to each other, which Google has put in separate blocks, and a smudge it wasn't sure of.
+const FULL_TEXT = `{"responses": [{
+	"textAnnotations": [{"description": "ignored"}],
+	"fullTextAnnotation": {"text": "STEPHEN KING\nDARK TOWER\n", "pages": [{"blocks": [
+		{"paragraphs": [{"words": [
+			{"confidence": 0.98, "boundingBox": {"vertices": [{"x": 110, "y": 20}, {"x": 110, "y": 125}, {"x": 90, "y": 125}, {"x": 90, "y": 20}]},
+			 "symbols": [{"text": "STEP"}, {"text": "HEN", "property": {"detectedBreak": {"type": "SPACE"}}}]},
+			{"confidence": 0.95, "boundingBox": {"vertices": [{"x": 110, "y": 140}, {"x": 110, "y": 200}, {"x": 90, "y": 200}, {"x": 90, "y": 140}]},
+			 "symbols": [{"text": "KING", "property": {"detectedBreak": {"type": "EOL_SURE_SPACE"}}}]}
+		]}]},
+		{"paragraphs": [{"words": [
+			{"confidence": 0.1, "boundingBox": {"vertices": [{"x": 120, "y": 0}, {"x": 120, "y": 10}, {"x": 115}, {"x": 115, "y": 10}]},
+			 "symbols": [{"text": "~", "property": {"detectedBreak": {"type": "SPACE"}}}]},
+			{"confidence": 0.9, "boundingBox": {"vertices": [{"x": 120, "y": 20}, {"x": 120, "y": 80}, {"x": 100, "y": 80}, {"x": 100, "y": 20}]},
+			 "symbols": [{"text": "DARK", "property": {"detectedBreak": {"type": "SPACE"}}}]},
+			{"boundingBox": {"vertices": [{"x": 120, "y": 90}, {"x": 120, "y": 165}, {"x": 100, "y": 165}, {"x": 100, "y": 90}]},
+			 "symbols": [{"text": "TOWER"}]}
+		]}]}
+	]}]}
+}]}`
+
+func TestFullTextAnnotation(t *testing.T) {
+	lines, fragments := GetLinesAndFragments(FULL_TEXT)
+	assert.Equal(t, []string{"STEPHEN KING", "DARK TOWER"}, lines)
+	assert.Equal(t, []string{"STEPHEN", "KING", "DARK", "TOWER"}, descriptions(fragments))
+	assert.Equal(t, []int{0, 0, 1, 1}, []int{fragments[0].SpineIndex, fragments[1].SpineIndex, fragments[2].SpineIndex, fragments[3].SpineIndex})
+	assert.Equal(t, 1, fragments[1].Block)
+	assert.Equal(t, 2, fragments[2].Block)
+	assert.Equal(t, 0.95, fragments[1].Confidence)
+	assert.Equal(t, 0.0, fragments[3].Confidence)
+	assert.Equal(t, 90, fragments[0].Orientation.Rotation)
+
+	// The spines are close enough that they'd run together if Google hadn't told us they were separate.
+	lines, _ = SegmentSpines(fragments)
+	assert.Equal(t, []string{"STEPHEN KING", "DARK TOWER"}, lines)
+
+	for i := range fragments {
+		fragments[i].Block = 0
+	}
+
+	lines, _ = SegmentSpines(fragments)
+	assert.Equal(t, 1, len(lines))
+
+	// Without the full text we use the annotations as before.
+	lines, fragments = GetLinesAndFragments(`{"textAnnotations": [{"description": "KING"}, {"description": "KING"}]}`)
+	assert.Equal(t, []string{"KING"}, lines)
+	assert.Equal(t, 1, len(fragments))
+}
+
+func TestFullTextHyphen(t *testing.T) {
+	// A hyphen at the end of a line is part of the word, not a break between spines.
+	lines, fragments := GetLinesAndFragments(`{"fullTextAnnotation": {"pages": [{"blocks": [{"paragraphs": [{"words": [
+		{"confidence": 0.9, "boundingBox": {"vertices": [{"x": 10, "y": 10}, {"x": 70, "y": 10}, {"x": 70, "y": 30}, {"x": 10, "y": 30}]},
+		 "symbols": [{"text": "DARK", "property": {"detectedBreak": {"type": "HYPHEN"}}}]},
+		{"confidence": 0.7, "boundingBox": {"vertices": [{"x": 10, "y": 40}, {"x": 70, "y": 40}, {"x": 70, "y": 60}, {"x": 10, "y": 60}]},
+		 "symbols": [{"text": "NESS", "property": {"detectedBreak": {"type": "SPACE"}}}]},
+		{"confidence": 0.9, "boundingBox": {"vertices": [{"x": 80, "y": 40}, {"x": 150, "y": 40}, {"x": 150, "y": 60}, {"x": 80, "y": 60}]},
+		 "symbols": [{"text": "FALLS"}]}
+	]}]}]}]}}`)
+
+	assert.Equal(t, []string{"DARKNESS FALLS"}, lines)
+	assert.Equal(t, []string{"DARKNESS", "FALLS"}, descriptions(fragments))
+	assert.Equal(t, 0.7, fragments[0].Confidence)
+	assert.Equal(t, []Vertices{{10, 10}, {70, 10}, {70, 60}, {10, 60}}, fragments[0].BoundingPoly.Vertices)
+	assert.Equal(t, 0, fragments[0].Orientation.Rotation)
+}
+
+func TestConfidenceLinks(t *testing.T) {
+	// Words close enough to be on the same spine, unless one of them might not be a word at all.
+	p, _ := placeFragment(verticalWord("STEPHEN", 100, 20))
+	q, _ := placeFragment(verticalWord("KING", 110, 140))
+	assert.True(t, p.sameSpine(q))
+
+	q.fragment.Confidence = 0.95
+	assert.True(t, p.sameSpine(q))
+
+	q.fragment.Confidence = 0.5
+	assert.False(t, p.sameSpine(q))
+	assert.False(t, q.sameSpine(p))
+}
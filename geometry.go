@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+)
+
+// Google leaves out any coordinate which is 0, which unmarshals to 0 anyway, but it also sometimes gives fewer than
+// four vertices, and text which runs off the edge of the image can have negative coordinates.  Normalise repairs the
+// polygon so that the rest of the code can rely on four vertices in reading order inside the image.  Where we don't
+// have all four we use the box around what we do have, which loses the angle but keeps the position.
+//
+// It returns false if there's nothing to go on - no vertices, or all in one spot.
+func (poly BoundingPoly) Normalise() (BoundingPoly, bool) {
+	if len(poly.Vertices) == 0 {
+		return BoundingPoly{}, false
+	}
+
+	vertices := make([]Vertices, len(poly.Vertices))
+
+	for i, v := range poly.Vertices {
+		vertices[i] = Vertices{X: maxInt(v.X, 0), Y: maxInt(v.Y, 0)}
+	}
+
+	ret := BoundingPoly{Vertices: vertices}
+
+	if len(vertices) != 4 {
+		minx, miny, maxx, maxy := ret.Box()
+		ret.Vertices = []Vertices{{minx, miny}, {maxx, miny}, {maxx, maxy}, {minx, maxy}}
+	}
+
+	minx, miny, maxx, maxy := ret.Box()
+
+	return ret, minx != maxx || miny != maxy
+}
+
+// The polygon with four vertices, or nil if it can't be repaired.
+func (poly BoundingPoly) corners() []Vertices {
+	if len(poly.Vertices) == 4 {
+		return poly.Vertices
+	}
+
+	if normal, ok := poly.Normalise(); ok {
+		return normal.Vertices
+	}
+
+	return nil
+}
+
+// Box is the smallest upright rectangle around the polygon, as left, top, right, bottom.
+func (poly BoundingPoly) Box() (int, int, int, int) {
+	if len(poly.Vertices) == 0 {
+		return 0, 0, 0, 0
+	}
+
+	minx, miny := poly.Vertices[0].X, poly.Vertices[0].Y
+	maxx, maxy := minx, miny
+
+	for _, v := range poly.Vertices[1:] {
+		minx, maxx = minInt(minx, v.X), maxInt(maxx, v.X)
+		miny, maxy = minInt(miny, v.Y), maxInt(maxy, v.Y)
+	}
+
+	return minx, miny, maxx, maxy
+}
+
+// Centroid is the middle of the polygon.
+func (poly BoundingPoly) Centroid() (float64, float64) {
+	v := poly.corners()
+
+	if v == nil {
+		return 0, 0
+	}
+
+	return float64(v[0].X+v[1].X+v[2].X+v[3].X) / 4, float64(v[0].Y+v[1].Y+v[2].Y+v[3].Y) / 4
+}
+
+// Angle is the direction the text runs in, in degrees clockwise from left to right.
+func (poly BoundingPoly) Angle() float64 {
+	dx, dy, _ := textDirection(poly)
+
+	return math.Atan2(dy, dx) * 180 / math.Pi
+}
+
+// Width is the length of the text, measured along it.
+func (poly BoundingPoly) Width() float64 {
+	v := poly.corners()
+	dx, dy, ok := textDirection(poly)
+
+	if !ok {
+		return 0
+	}
+
+	return math.Max(float64(v[1].X-v[0].X)*dx+float64(v[1].Y-v[0].Y)*dy, float64(v[2].X-v[3].X)*dx+float64(v[2].Y-v[3].Y)*dy)
+}
+
+// Height is the letter height, measured across the text.
+func (poly BoundingPoly) Height() float64 {
+	v := poly.corners()
+
+	if v == nil {
+		return 0
+	}
+
+	return math.Hypot(float64(v[3].X-v[0].X), float64(v[3].Y-v[0].Y))
+}
+
+// The smallest polygon around both, running the same way as the text in the first.  That's for a word which Google has
+// split in two, where the halves can be on different lines.
+func mergePolys(a BoundingPoly, b BoundingPoly) BoundingPoly {
+	all := append(append([]Vertices{}, a.Vertices...), b.Vertices...)
+	dx, dy, ok := textDirection(a)
+
+	if !ok {
+		dx, dy, ok = textDirection(b)
+	}
+
+	if !ok {
+		merged, _ := BoundingPoly{Vertices: all}.Normalise()
+		return merged
+	}
+
+	// Measure along the text and down it, which is the direction turned a quarter clockwise.
+	minalong, maxalong := math.Inf(1), math.Inf(-1)
+	mindown, maxdown := math.Inf(1), math.Inf(-1)
+
+	for _, v := range all {
+		along := float64(v.X)*dx + float64(v.Y)*dy
+		down := -float64(v.X)*dy + float64(v.Y)*dx
+		minalong, maxalong = math.Min(minalong, along), math.Max(maxalong, along)
+		mindown, maxdown = math.Min(mindown, down), math.Max(maxdown, down)
+	}
+
+	corner := func(along float64, down float64) Vertices {
+		return Vertices{
+			X: int(math.Round(along*dx - down*dy)),
+			Y: int(math.Round(along*dy + down*dx)),
+		}
+	}
+
+	return BoundingPoly{Vertices: []Vertices{
+		corner(minalong, mindown),
+		corner(maxalong, mindown),
+		corner(maxalong, maxdown),
+		corner(minalong, maxdown),
+	}}
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalise(t *testing.T) {
+	// Google leaves out zero coordinates, gives fewer vertices than it should, and runs off the edge of the image.
+	lines, fragments := GetLinesAndFragments(`[
+		{"description": "EDGE\nSHORT NONE"},
+		{"description": "EDGE", "boundingPoly": {"vertices": [{"x": -5}, {"x": 60}, {"x": 60, "y": 20}, {"y": 20}]}},
+		{"description": "SHORT", "boundingPoly": {"vertices": [{"x": 100, "y": 40}, {"x": 30, "y": 10}]}},
+		{"description": "NONE"}
+	]`)
+
+	assert.Equal(t, []string{"EDGE", "SHORT NONE"}, lines)
+	assert.Equal(t, []Vertices{{0, 0}, {60, 0}, {60, 20}, {0, 20}}, fragments[0].BoundingPoly.Vertices)
+	assert.Equal(t, []Vertices{{30, 10}, {100, 10}, {100, 40}, {30, 40}}, fragments[1].BoundingPoly.Vertices)
+	assert.Equal(t, 0, len(fragments[2].BoundingPoly.Vertices))
+
+	// A single point has no size.
+	_, ok := BoundingPoly{Vertices: []Vertices{{X: 10, Y: 10}}}.Normalise()
+	assert.False(t, ok)
+
+	// None of which should upset anything that measures them.
+	assert.Equal(t, 20, MaxDimension(fragments[0].BoundingPoly))
+	assert.Equal(t, 0, MaxDimension(fragments[2].BoundingPoly))
+	assert.Equal(t, 30, MaxDimension(BoundingPoly{Vertices: []Vertices{{X: 100, Y: 40}, {X: 30, Y: 10}}}))
+	assert.Equal(t, 0, MaxDimension(BoundingPoly{}))
+	_, _, pruned := PruneSmallText(lines, fragments, PRUNE_SMALL_TEXT)
+	assert.Equal(t, 1, pruned)
+}
+
+func TestMergePolys(t *testing.T) {
+	// A word on a spine split across two lines of text keeps running down the spine.
+	merged := mergePolys(verticalWord("DARK", 100, 20).BoundingPoly, verticalWord("NESS", 75, 20).BoundingPoly)
+	assert.Equal(t, []Vertices{{110, 20}, {110, 80}, {65, 80}, {65, 20}}, merged.Vertices)
+	assert.Equal(t, 90.0, merged.Angle())
+
+	// With nothing to say which way the text runs, we have the box around it.
+	merged = mergePolys(BoundingPoly{}, BoundingPoly{Vertices: []Vertices{{X: 5, Y: 5}, {X: 15, Y: 25}}})
+	assert.Equal(t, []Vertices{{5, 5}, {15, 5}, {15, 25}, {5, 25}}, merged.Vertices)
+}
+
+func TestPolyHelpers(t *testing.T) {
+	poly := verticalWord("DOWN", 100, 20).BoundingPoly
+	x, y := poly.Centroid()
+	assert.Equal(t, 100.0, x)
+	assert.Equal(t, 50.0, y)
+	assert.Equal(t, 90.0, poly.Angle())
+	assert.Equal(t, 60.0, poly.Width())
+	assert.Equal(t, 20.0, poly.Height())
+
+	left, top, right, bottom := poly.Box()
+	assert.Equal(t, []int{90, 20, 110, 80}, []int{left, top, right, bottom})
+
+	poly = risingWord("UP", 100, 100).BoundingPoly
+	assert.Equal(t, -90.0, poly.Angle())
+	assert.Equal(t, 30.0, poly.Width())
+	assert.Equal(t, 20.0, poly.Height())
+
+	// Nothing to measure.
+	assert.Equal(t, 0.0, BoundingPoly{}.Width())
+	assert.Equal(t, 0.0, BoundingPoly{}.Height())
+}
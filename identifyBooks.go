@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/patrickmn/go-cache"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,54 +23,242 @@ type phase struct {
 
 const MAXRESULTS = 1000
 
+// The default for how many candidates we report per spine.
+const MAXCANDIDATES = 5
+
+// The default for how many searches the permuted and mangled phases can run for one image.  The number of orders is
+// factorial in the number of spines, so without a limit a messy shelf could take forever.
+const PERMUTE_BUDGET = 2000
+
+// The most words we split spines into for the mangled phase.
+const MANGLED_MAX_WORDS = 6
+
 type searchResult struct {
 	spineindex   int
+	firstspine   int // Usually the same, but a known title can start on an earlier spine
 	phaseid      int
 	searchAuthor string
 	searchTitle  string
 	foundAuthor  string
 	foundTitle   string
 	foundVIAF    string
+	authorScore  int
+	titleScore   int
+	strategy     int
+	popularity   int
+}
+
+// How we found a result.
+const (
+	MATCH_AUTHOR_TITLE = iota // Fuzzy search on both author and title
+	MATCH_AUTHOR              // Fuzzy search on the author, then compare the titles
+	MATCH_TITLE               // Fuzzy search on the title, then compare the authors
+	MATCH_KNOWN_AUTHOR        // A title by an author we'd already found elsewhere on the shelf
+)
+
+// How much less we trust a result because of how we found it.  A match on both author and title is the best we can
+// do.  The author on its own, or a title, ranks the catalogue differently and lets through more near misses.  Known
+// author matches never saw the author on the spine at all.
+var strategyDoubt = map[int]int{
+	MATCH_AUTHOR_TITLE: 0,
+	MATCH_AUTHOR:       5,
+	MATCH_TITLE:        5,
+	MATCH_KNOWN_AUTHOR: 10,
+}
+
+// Likewise for the phase.  Moving words and spines around is more likely to produce a coincidental match.
+func (p phase) doubt() int {
+	switch {
+	case p.mangled:
+		return 15
+	case p.permuted:
+		return 10
+	case p.adjacent:
+		return 5
+	}
+
+	return 0
+}
+
+// How well the text matched.
+func (result searchResult) score() int {
+	return (result.authorScore + result.titleScore) / 2
+}
+
+// How sure we are of a result, 0-100.  Mostly that's how well the text matched.
+func (result searchResult) confidence(p phase) int {
+	c := result.score() - p.doubt() - strategyDoubt[result.strategy]
+
+	if c < 0 {
+		c = 0
+	} else if c > 100 {
+		c = 100
+	}
+
+	return c
 }
 
-var searchResults map[searchResult]searchResult
-var gotSpine map[int]bool
-var resultsMux sync.Mutex
+// An Identifier identifies the books in an image.  It holds everything a run needs, so separate Identifiers can
+// work on separate images at the same time.  A single Identifier only handles one image at a time.
+type Identifier struct {
+	catalogue Catalogue
+
+	// Most catalogue searches to run at once.
+	Concurrency int
+
+	// Most candidates to report per spine.
+	MaxCandidates int
+
+	// Choose between the candidates across the whole shelf, rather than taking the first found for each spine.
+	Global bool
+
+	// The catalogue vocabulary, used to correct OCR mistakes in the fuzzy phases.  Without it those phases search
+	// the text as it is.
+	Dictionary *dictionary
+
+	// Most searches the permuted and mangled phases can run for one image.  0 turns those phases off.
+	PermuteBudget int
+	permuted      int
+
+	mux        sync.Mutex
+	results    map[searchResult]searchResult
+	candidates map[int][]searchResult
+	gotSpine   map[int]bool
+	errors     []error
+}
+
+func NewIdentifier(c Catalogue) *Identifier {
+	return &Identifier{
+		catalogue:     c,
+		Concurrency:   SEARCH_CONCURRENCY,
+		MaxCandidates: MAXCANDIDATES,
+		PermuteBudget: PERMUTE_BUDGET,
+	}
+}
+
+// SearchError is returned by IdentifyBooks when searches fail even after retrying.  The spines returned with it are
+// still valid, but probably not as complete as they would otherwise have been.
+type SearchError struct {
+	Errors []error
+}
 
-func addResult(result searchResult) {
+func (e *SearchError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+
+	return fmt.Sprintf("%d searches failed, first: %s", len(e.Errors), e.Errors[0])
+}
+
+func (id *Identifier) addResult(result searchResult) {
 	sugar.Debugf("Add result %+v", result)
 	// We want the results to be unique by found values in a single spine.  We might have searched on different
 	// variants but found the same thing.
 	key := result
 	key.searchTitle = ""
 	key.searchAuthor = ""
+	key.authorScore = 0
+	key.titleScore = 0
+	key.strategy = 0
+	key.firstspine = 0
+	key.popularity = 0
 
-	resultsMux.Lock()
+	id.mux.Lock()
 
-	if !gotSpine[result.spineindex] {
-		searchResults[key] = result
+	if !id.gotSpine[result.spineindex] {
+		id.results[key] = result
 		sugar.Debugf("Phase %d found result on %d, %s - %s", result.phaseid, result.spineindex, result.foundAuthor, result.foundTitle)
-		gotSpine[result.spineindex] = true
+		id.gotSpine[result.spineindex] = true
 	}
 
-	resultsMux.Unlock()
+	// Only the first result identifies the spine, but keep the rest in case one of them is better.
+	id.candidates[result.spineindex] = append(id.candidates[result.spineindex], result)
+
+	id.mux.Unlock()
 }
 
-func clearResults() {
-	searchResults = map[searchResult]searchResult{}
-	gotSpine = map[int]bool{}
+// The candidates for a spine, best first, with no duplicates.
+func (id *Identifier) rankCandidates(results []searchResult, p phase) []Candidate {
+	candidates := []Candidate{}
+	seen := map[string]int{}
+
+	for _, result := range results {
+		candidate := Candidate{
+			Author:     result.foundAuthor,
+			Title:      result.foundTitle,
+			VIAF:       result.foundVIAF,
+			Confidence: result.confidence(p),
+			Popularity: result.popularity,
+		}
+
+		key := strings.ToLower(candidate.Author + "-" + candidate.Title)
+
+		if index, ok := seen[key]; ok {
+			if candidate.Confidence > candidates[index].Confidence {
+				candidates[index] = candidate
+			}
+		} else {
+			seen[key] = len(candidates)
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	sort.SliceStable(candidates, func(a, b int) bool {
+		if candidates[a].Confidence != candidates[b].Confidence {
+			return candidates[a].Confidence > candidates[b].Confidence
+		}
+
+		return candidates[a].Popularity > candidates[b].Popularity
+	})
+
+	if len(candidates) > id.MaxCandidates {
+		candidates = candidates[0:id.MaxCandidates]
+	}
+
+	return candidates
+}
+
+func (id *Identifier) addError(err error) {
+	sugar.Errorf("Search failed: %s", err)
+	id.mux.Lock()
+	id.errors = append(id.errors, err)
+	id.mux.Unlock()
+}
+
+// Once a search has failed we stop starting new ones.  The retries are in the search itself, so anything which gets
+// this far is unlikely to be better next time.
+func (id *Identifier) searchFailed() bool {
+	id.mux.Lock()
+	ret := len(id.errors) > 0
+	id.mux.Unlock()
+	return ret
 }
 
-func checkResult(spineindex int) bool {
-	resultsMux.Lock()
-	ret := gotSpine[spineindex]
-	resultsMux.Unlock()
+func (id *Identifier) clearResults() {
+	id.results = map[searchResult]searchResult{}
+	id.candidates = map[int][]searchResult{}
+	id.gotSpine = map[int]bool{}
+}
+
+func (id *Identifier) checkResult(spineindex int) bool {
+	id.mux.Lock()
+	ret := id.gotSpine[spineindex]
+	id.mux.Unlock()
 	//sugar.Infof("Check result on %d, %t", spineindex, ret)
 	return ret
 }
 
-func IdentifyBooks(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRFragment) {
+func (id *Identifier) resultCount() int {
+	id.mux.Lock()
+	ret := len(id.results)
+	id.mux.Unlock()
+	return ret
+}
+
+func (id *Identifier) IdentifyBooks(ctx context.Context, spines []Spine, fragments []OCRFragment) ([]Spine, []OCRFragment, error) {
 	phases := setUpPhases()
+	id.errors = nil
+	id.permuted = 0
 
 	// We need to execute the phases serially as the results of one phase make it more likely that we can find things
 	// in later phases.
@@ -80,35 +269,50 @@ func IdentifyBooks(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRFragm
 		sugar.Debugf("Spines at start of phase %+v", spines)
 		start := time.Now()
 
-		clearResults()
-		searchSpines(spines, fragments, p, 0, len(spines))
+		id.clearResults()
+		id.searchSpines(ctx, spines, fragments, p, 0, len(spines))
 		sugar.Debugf("Spines after search phase %+v", spines)
-		spines, fragments = processSearchResults(spines, fragments)
+		spines, fragments = id.processSearchResults(spines, fragments, p)
 		sugar.Debugf("Spines after process %+v", spines)
 
-		if p.mangled || p.permuted || p.adjacent {
-			clearResults()
-			spines, fragments = searchBrokenSpines(spines, fragments, p)
-			spines, fragments = processSearchResults(spines, fragments)
+		if (p.mangled || p.permuted || p.adjacent) && ctx.Err() == nil {
+			id.clearResults()
+			spines, fragments = id.searchBrokenSpines(ctx, spines, fragments, p)
+			spines, fragments = id.processSearchResults(spines, fragments, p)
 			sugar.Debugf("Spines after broken %+v", spines)
 		}
 
 		duration := time.Since(start)
-		sugar.Debugf("Phase %d %+v found %d in %v", p.id, p, len(searchResults), duration)
+		sugar.Debugf("Phase %d %+v found %d in %v", p.id, p, id.resultCount(), duration)
 
 		if phaseindex > 4 && countSuccess(spines) == 0 {
 			// We've done a bit and not found anything.  Probably a bad image.  Bail out to stop it taking forever.
 			sugar.Infof("Bail out.")
 			cont = false
 		}
+
+		if id.searchFailed() {
+			// No point carrying on - return what we have so far.
+			sugar.Errorf("Searches failing, stop after phase %d", p.id)
+			cont = false
+		}
+
+		if ctx.Err() != nil {
+			// Out of time (or cancelled).  Again, return what we have so far.
+			sugar.Infof("Stop after phase %d: %s", p.id, ctx.Err())
+			cont = false
+		}
 	}
 
 	sugar.Debugf("All phases complete")
 
-	// Now use our found authors to try harder for title matches.
-	searchResults = map[searchResult]searchResult{}
-	spines, fragments = knownAuthorTitles(spines, fragments)
-	spines, fragments = processSearchResults(spines, fragments)
+	if !id.searchFailed() && ctx.Err() == nil {
+		// Now use our found authors to try harder for title matches.
+		id.results = map[searchResult]searchResult{}
+		id.candidates = map[int][]searchResult{}
+		spines, fragments = id.knownAuthorTitles(ctx, spines, fragments)
+		spines, fragments = id.processSearchResults(spines, fragments, phase{})
+	}
 
 	for _, frag := range fragments {
 		if !frag.Used {
@@ -124,14 +328,29 @@ func IdentifyBooks(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRFragm
 		}
 	}
 
-	return spines, fragments
+	// Merging and splitting spines moves them along their shelves.
+	spines = numberSpines(spines)
+
+	if id.searchFailed() {
+		return spines, fragments, &SearchError{
+			Errors: id.errors,
+		}
+	}
+
+	// If we ran out of time then the results are partial.  Tell the caller why.
+	return spines, fragments, ctx.Err()
 }
 
-func processSearchResults(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRFragment) {
+func (id *Identifier) processSearchResults(spines []Spine, fragments []OCRFragment, p phase) ([]Spine, []OCRFragment) {
 	// Get the results as an array.
-	results := make([]searchResult, 0, len(searchResults))
-	for _, v := range searchResults {
-		results = append(results, v)
+	results := make([]searchResult, 0, id.resultCount())
+
+	if id.Global {
+		results = assignCandidates(spines, id.candidates, p)
+	} else {
+		for _, v := range id.results {
+			results = append(results, v)
+		}
 	}
 
 	// We want to process the results in the order of the longest match in a spine first.  That reduces false
@@ -148,6 +367,11 @@ func processSearchResults(spines []Spine, fragments []OCRFragment) ([]Spine, []O
 		spines[result.spineindex].Author = result.foundAuthor
 		spines[result.spineindex].Title = result.foundTitle
 		spines[result.spineindex].VIAF = result.foundVIAF
+		spines[result.spineindex].Confidence = result.confidence(p)
+
+		if id.MaxCandidates > 0 {
+			spines[result.spineindex].Candidates = id.rankCandidates(id.candidates[result.spineindex], p)
+		}
 		fragments = flagUsed(fragments, result.spineindex)
 		spines, fragments = checkAdjacent(spines, fragments, result)
 	}
@@ -158,13 +382,10 @@ func processSearchResults(spines []Spine, fragments []OCRFragment) ([]Spine, []O
 	return spines, fragments
 }
 
-func knownAuthorTitles(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRFragment) {
+func (id *Identifier) knownAuthorTitles(ctx context.Context, spines []Spine, fragments []OCRFragment) ([]Spine, []OCRFragment) {
 	// Now we hopefully have a bunch of books and authors.  People often buy multiple books by the same author, so
 	// we may have leftover spines for those which we didn't manage to match so far.  We can be pretty confident that
 	// any titles which match a title from a known author are by that author - so lets look for them.
-	//
-	// on Wipe the cache first as we may have entries with fewer results than we want to check here.
-	elasticCache = cache.New(cache.NoExpiration, 10*time.Minute)
 	matchedspines := map[int]bool{}
 	matchedtitles := map[string]bool{}
 
@@ -172,26 +393,23 @@ func knownAuthorTitles(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRF
 		if len(spine.Author) > 0 {
 			sugar.Debugf("Collect titles for known author %s %s", spine.VIAF, spine.Author)
 
-			query := map[string]interface{}{
-				"query": map[string]interface{}{
-					"match": map[string]interface{}{
-						"viafid": spine.VIAF,
-					},
-				},
+			works, err := id.catalogue.WorksByVIAF(ctx, spine.VIAF, 500)
+
+			if err != nil && ctx.Err() == nil {
+				id.addError(err)
 			}
 
-			r2, _ := performCachedSearch(spine.VIAF+"-", query, 500)
-			for _, hit2 := range r2["hits"].(map[string]interface{})["hits"].([]interface{}) {
-				data2 := hit2.(map[string]interface{})["_source"]
-				hitauthor := fmt.Sprintf("%v", data2.(map[string]interface{})["author"])
-				hittitle := fmt.Sprintf("%v", data2.(map[string]interface{})["title"])
-				viafid := fmt.Sprintf("%v", data2.(map[string]interface{})["viafid"])
+			for _, work := range works {
+				hitauthor := work.Author
+				hittitle := work.Title
+				viafid := work.VIAF
 
 				if len(hittitle) > 0 && !matchedtitles[hittitle] {
 					sugar.Debugf("Look for known title %s by %s %s", hittitle, spine.Author, viafid)
 					titlewordindex := 0
 					titlewords := strings.Split(strings.ToLower(hittitle), " ")
 					spineindex := 0
+					startspine := 0
 					swi := 0
 
 					for ok := true; ok; {
@@ -224,6 +442,7 @@ func knownAuthorTitles(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRF
 										// We found the start.
 										matching = true
 										swi = i
+										startspine = spineindex
 										sugar.Debugf("Found start of %s at %d in %s", hittitle, i, spine.Spine)
 									}
 								}
@@ -252,13 +471,17 @@ func knownAuthorTitles(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRF
 											matchedtitles[hittitle] = true
 											ok = false
 
-											addResult(searchResult{
+											id.addResult(searchResult{
 												spineindex:   spineindex,
+												firstspine:   startspine,
 												searchAuthor: hitauthor,
 												searchTitle:  hittitle,
 												foundAuthor:  hitauthor,
 												foundTitle:   hittitle,
 												foundVIAF:    spine.VIAF,
+												authorScore:  HIGHCONFIDENCE,
+												titleScore:   HIGHCONFIDENCE,
+												strategy:     MATCH_KNOWN_AUTHOR,
 											})
 										} else {
 											sugar.Debugf("Failed sanity")
@@ -266,10 +489,16 @@ func knownAuthorTitles(spines []Spine, fragments []OCRFragment) ([]Spine, []OCRF
 										}
 									} else {
 										if swi >= len(spinewords) {
-											// Move to next spine.
-											sugar.Debugf("...move to next spine")
-											spineindex++
-											swi = 0
+											if spineindex+1 < len(spines) && !sameShelf(spines, spineindex, spineindex+1) {
+												// A title can't carry on onto another shelf.
+												sugar.Debugf("...next spine is on another shelf")
+												matching = false
+											} else {
+												// Move to next spine.
+												sugar.Debugf("...move to next spine")
+												spineindex++
+												swi = 0
+											}
 										} else {
 											sugar.Debugf("Continue at %d of %d", swi, len(spinewords))
 										}
@@ -332,7 +561,7 @@ func checkAdjacent(spines []Spine, fragments []OCRFragment, result searchResult)
 		s = regexp.MustCompile("(?i)" + regexp.QuoteMeta(residual))
 
 		for _, i := range cmp {
-			if len(spines[i].Author) == 0 && s.MatchString(spines[i].Spine) {
+			if len(spines[i].Author) == 0 && sameShelf(spines, i, result.spineindex) && s.MatchString(spines[i].Spine) {
 				sugar.Debugf("Remove rest of title %s in %s", residual, spines[i].Spine)
 				spines[i].Spine = s.ReplaceAllString(spines[i].Spine, "")
 			}
@@ -394,12 +623,13 @@ func extractKnownAuthors(spines []Spine, fragments []OCRFragment) ([]Spine, []OC
 							swi = 0
 							si++
 
-							if len(spines[si].Author) > 0 {
-								// Wouldn't be safe to merge with a spine that's already matched.
+							if si >= len(spines) || len(spines[si].Author) > 0 || !sameShelf(spines, si, spineindex) {
+								// Wouldn't be safe to merge with a spine that's already matched, or one which only
+								// looks next to this one because it's at the other end of another shelf.
 								ok = false
+							} else {
+								spinewords = strings.Split(spines[si].Spine, " ")
 							}
-
-							spinewords = strings.Split(spines[si].Spine, " ")
 						}
 					} else {
 						ok = false
@@ -464,6 +694,33 @@ func mergeSpines(spines []Spine, fragments []OCRFragment, comspined Spine, start
 	return spines, fragments
 }
 
+// The opposite of mergeSpines - the spines from start for length have been split into words, adding some spines.
+// Fragments above move along, and fragments in the split go to the word they match.  We can't use AddSpineIndex for
+// this because the spines have been cleaned, and perhaps merged, so the words don't line up with the fragments.
+func splitFragments(spines []Spine, fragments []OCRFragment, start int, length int, added int) []OCRFragment {
+	claimed := map[int]bool{}
+
+	for fragindex, frag := range fragments {
+		if frag.SpineIndex >= start+length {
+			fragments[fragindex].SpineIndex += added
+		} else if frag.SpineIndex >= start {
+			// If we can't find the word it's probably been cleaned away; leave it with the first one.
+			fragments[fragindex].SpineIndex = start
+			word := CleanOCR(frag.Description)
+
+			for spineindex := start; spineindex < start+length+added && spineindex < len(spines); spineindex++ {
+				if !claimed[spineindex] && strings.EqualFold(CleanOCR(spines[spineindex].Spine), word) {
+					fragments[fragindex].SpineIndex = spineindex
+					claimed[spineindex] = true
+					break
+				}
+			}
+		}
+	}
+
+	return fragments
+}
+
 func setUpPhases() []phase {
 	// We scan the text to identify spines.  We have various techniques for this:
 	//
@@ -659,27 +916,12 @@ func NormalizeTitle(title string) string {
 	return title
 }
 
-func searchSpines(spines []Spine, fragments []OCRFragment, phase phase, start int, length int) {
+// Returns how many searches we ran.
+func (id *Identifier) searchSpines(ctx context.Context, spines []Spine, fragments []OCRFragment, phase phase, start int, length int) int {
 	sugar.Debugf("Search spines start %d len %d phase %+v", start, length, phase)
 
 	order := getOrder(spines, start, length)
 
-	if phase.fuzzy {
-		// Fuzzy match using DB of known words.  This has the frequency values in it and is therefore likely to
-		// yield a better result than what happens within an each ElasticDB search, though we still do that
-		// for authors as it works better.
-		// TODO
-	}
-
-	type searchEntry struct {
-		phaseid    int
-		spineindex int
-		author     string
-		title      string
-		wordindex  int
-	}
-
-	var wg sync.WaitGroup
 	searches := []searchEntry{}
 
 	for _, o := range order {
@@ -694,9 +936,19 @@ func searchSpines(spines []Spine, fragments []OCRFragment, phase phase, start in
 			// harder to identify - probably it contains multiple books, and so will be hard to identify unless we
 			// are lucky enough to be able to match at the start
 			//
-			// Use a wait group so that we can do that in parallel.
+			// Queue them up so that we can do that in parallel.
 			sugar.Debugf("Spine %d %s", spineindex, spine.Spine)
-			words := strings.Split(spines[o.index].Spine, " ")
+			text := spine.Spine
+
+			if phase.fuzzy && id.Dictionary != nil {
+				// Fuzzy match using the catalogue's own words.  This has the frequency values in it and is therefore
+				// likely to yield a better result than what happens within an each ElasticDB search, though we still
+				// do that for authors as it works better.
+				text = id.Dictionary.correctText(text)
+				sugar.Debugf("Corrected spine %d to %s", spineindex, text)
+			}
+
+			words := strings.Split(text, " ")
 
 			// If it doesn't have two words, it can't have an author and a title.
 			if len(words) >= 2 && len(words) < 10 {
@@ -719,7 +971,6 @@ func searchSpines(spines []Spine, fragments []OCRFragment, phase phase, start in
 						sugar.Debugf("Consider author last split in spine %d at %d %s - %s", spineindex, wordindex, author, title)
 					}
 
-					wg.Add(1)
 					searches = append(searches, searchEntry{
 						phaseid:    phase.id,
 						spineindex: spineindex,
@@ -732,37 +983,37 @@ func searchSpines(spines []Spine, fragments []OCRFragment, phase phase, start in
 		}
 	}
 
-	// We're playing a balancing game - if we find a result early then we can save on other searches.  So we don't
-	// want to do all searches for the same spine simultanously.  Sorting by word order means we are less likely.
-	sort.Slice(searches, func(i, j int) bool {
-		if searches[i].wordindex != searches[j].wordindex {
-			return searches[i].wordindex > searches[j].wordindex
+	// Now run them, longest split first, on a limited number of workers.
+	var count int64
+	queue := newSearchQueue(searches)
+	queue.run(id.Concurrency, func(s searchEntry) {
+		// By the time this gets invoked, it's possible that someone else has identified this spine.
+		// If so, no point in us searching too.  There's still a timing window where two can identify
+		// at the same time, but that's ok - this is just a speedup.
+		if id.searchFailed() || ctx.Err() != nil {
+			sugar.Debugf("Searches failing or out of time, skip %s - %s", s.author, s.title)
+		} else if !id.checkResult(s.spineindex) {
+			sugar.Debugf("Now search %s - %s", s.author, s.title)
+			atomic.AddInt64(&count, 1)
+
+			if err := id.search(ctx, s.spineindex, s.author, s.title, phase.authorplustitle, s.phaseid); err != nil && ctx.Err() == nil {
+				id.addError(err)
+			}
+
+			if id.checkResult(s.spineindex) {
+				// Found it - the rest of the searches for this spine are redundant.
+				dropped := queue.drop(s.spineindex)
+				sugar.Debugf("Identified %d, dropped %d searches", s.spineindex, dropped)
+			}
 		} else {
-			return searches[i].spineindex > searches[j].spineindex
+			sugar.Debugf("Already identified %d, skip search", s.spineindex)
 		}
 	})
 
-	// Now fire them all off simultaneously.
-	for _, s := range searches {
-		go func(author string, title string, spineindex int, wordindex int, phaseid int) {
-			defer wg.Done()
-
-			// By the time this gets invoked, it's possible that someone else has identified this spine.
-			// If so, no point in us searching too.  There's still a timing window where two can identify
-			// at the same time, but that's ok - this is just a speedup.
-			if !checkResult(spineindex) {
-				sugar.Debugf("Now search %s - %s", author, title)
-				search(spineindex, author, title, phase.authorplustitle, phaseid)
-			} else {
-				sugar.Debugf("Already identified %d, skip search", spineindex)
-			}
-		}(s.author, s.title, s.spineindex, s.wordindex, s.phaseid)
-	}
-
-	wg.Wait()
+	return int(count)
 }
 
-func searchBrokenSpines(spines []Spine, fragments []OCRFragment, phase phase) ([]Spine, []OCRFragment) {
+func (id *Identifier) searchBrokenSpines(ctx context.Context, spines []Spine, fragments []OCRFragment, phase phase) ([]Spine, []OCRFragment) {
 	// Up to this point we've relied on what Google returns on a single line.  We will have found
 	// some books via that route.  But it's common to have the author on one line, and the book on another,
 	// or other variations which result in text on a single spine being split.
@@ -773,24 +1024,33 @@ func searchBrokenSpines(spines []Spine, fragments []OCRFragment, phase phase) ([
 	// Mangled spines are slower but they have a separate limit on the number of words.
 	max := 5
 
-	for adjacent := 2; adjacent <= max; adjacent++ {
+	for adjacent := 2; adjacent <= max && ctx.Err() == nil && (phase.adjacent || id.permuteBudgetLeft()); adjacent++ {
 		sugar.Debugf("Start run for adjacent %d", adjacent)
+
+		if phase.adjacent {
+			// All the windows of this length can be searched at once.  Merging spines can make new windows available,
+			// so go round again while that finds something.
+			for found := true; found && ctx.Err() == nil && !id.searchFailed(); {
+				spines, fragments, found = id.searchAdjacentSpines(ctx, spines, fragments, adjacent, phase)
+			}
+
+			continue
+		}
+
+		// A window can run right up to the last spine, so a broken book at the end of the shelf is searched too.
 		spineindex := 0
 
-		for ok := true; ok; {
+		for ok := adjacent <= len(spines); ok; {
 			thisone := spines[spineindex]
 
-			if len(thisone.Author) == 0 && len(thisone.Spine) > 0 && spineindex+adjacent < len(spines) {
+			if len(thisone.Author) == 0 && len(thisone.Spine) > 0 && spineindex+adjacent <= len(spines) {
 				sugar.Debugf("Consider broken spine %s at %d length %d", thisone.Spine, spineindex, adjacent)
 
 				available := true
-				healedtext := ""
 
 				for next := spineindex; next < len(spines) && next-spineindex+1 <= adjacent; next++ {
-					if len(spines[next].Author) > 0 {
+					if len(spines[next].Author) > 0 || !sameShelf(spines, spineindex, next) {
 						available = false
-					} else {
-						healedtext += " " + spines[next].Spine
 					}
 				}
 
@@ -799,13 +1059,10 @@ func searchBrokenSpines(spines []Spine, fragments []OCRFragment, phase phase) ([
 
 					var found bool
 
-					if phase.adjacent {
-						spines, fragments, found = searchForAdjacentSpines(spines, fragments, spineindex, adjacent, phase)
-					} else if phase.permuted {
-						//spines, fragments, found = searchForPermutedSpines(spines, fragments, spineindex, adjacent, phase)
+					if phase.permuted {
+						spines, fragments, found = id.searchForPermutedSpines(ctx, spines, fragments, spineindex, adjacent, phase)
 					} else if phase.mangled {
-						// TODO
-						//spines, fragments, found = searchForMangledSpines(spines, fragments, spineindex, adjacent, phase)
+						spines, fragments, found = id.searchForMangledSpines(ctx, spines, fragments, spineindex, adjacent, phase)
 					}
 
 					if found {
@@ -817,7 +1074,7 @@ func searchBrokenSpines(spines []Spine, fragments []OCRFragment, phase phase) ([
 
 			spineindex++
 
-			if spineindex+adjacent >= len(spines) {
+			if spineindex+adjacent > len(spines) || ctx.Err() != nil || !id.permuteBudgetLeft() {
 				ok = false
 			}
 		}
@@ -826,35 +1083,73 @@ func searchBrokenSpines(spines []Spine, fragments []OCRFragment, phase phase) ([
 	return spines, fragments
 }
 
-func permutations(arr []int) [][]int {
-	var helper func([]int, int)
-	res := [][]int{}
+func (id *Identifier) permuteBudgetLeft() bool {
+	return id.permuted < id.PermuteBudget
+}
 
-	helper = func(arr []int, n int) {
-		if n == 1 {
-			tmp := make([]int, len(arr))
-			copy(tmp, arr)
-			res = append(res, tmp)
-		} else {
-			for i := 0; i < n; i++ {
-				helper(arr, n-1)
-				if n%2 == 1 {
-					tmp := arr[i]
-					arr[i] = arr[n-1]
-					arr[n-1] = tmp
-				} else {
-					tmp := arr[0]
-					arr[0] = arr[n-1]
-					arr[n-1] = tmp
-				}
-			}
+// Could this spine be where an author starts (or ends, if the author comes last)?  Authors don't have numbers, and
+// need at least one word long enough to survive normalisation.  If we know the catalogue's words then one of them has
+// to be one of those too.  This loses authors which start with initials on a spine of their own, but those are rare
+// and the saving is large - most of the orders we'd try have a title word or a publisher where the author should be.
+func (id *Identifier) plausibleAuthor(text string) bool {
+	if id.Dictionary != nil {
+		text = id.Dictionary.correctText(text)
+	}
+
+	words := strings.Fields(NormalizeAuthor(text))
+
+	if len(words) == 0 || id.Dictionary == nil {
+		return len(words) > 0
+	}
+
+	for _, word := range words {
+		if id.Dictionary.words[word] > 0 {
+			return true
 		}
 	}
-	helper(arr, len(arr))
-	return res
+
+	return false
+}
+
+// A window of adjacent spines which we've joined and searched on a copy of the shelf.
+type adjacentWindow struct {
+	start      int
+	length     int
+	candidates []searchResult // The first one is what identified it
+	score      int            // The best confidence of the candidates
+}
+
+func (w *adjacentWindow) overlaps(other *adjacentWindow) bool {
+	return w.start < other.start+other.length && other.start < w.start+w.length
+}
+
+// A separate Identifier for searching a copy of the spines at the same time as others.  It shares our catalogue and
+// settings but has its own results.
+func (id *Identifier) fork() *Identifier {
+	child := &Identifier{
+		catalogue:     id.catalogue,
+		Concurrency:   id.Concurrency,
+		MaxCandidates: id.MaxCandidates,
+		Global:        id.Global,
+		Dictionary:    id.Dictionary,
+	}
+
+	child.clearResults()
+
+	return child
+}
+
+func joinSpines(spines []Spine, start int, length int) string {
+	healed := ""
+
+	for spineindex := start; spineindex < start+length; spineindex++ {
+		healed += " " + spines[spineindex].Spine
+	}
+
+	return healed
 }
 
-func searchForAdjacentSpines(spines []Spine, fragments []OCRFragment, start int, length int, phase phase) ([]Spine, []OCRFragment, bool) {
+func (id *Identifier) searchAdjacentSpines(ctx context.Context, spines []Spine, fragments []OCRFragment, length int, phase phase) ([]Spine, []OCRFragment, bool) {
 	// We want to join adjacent spines to see if we can find a match that way.
 	//
 	// Because we search on normalised values, which include sorting, then by joining a spine we automatically get
@@ -882,48 +1177,188 @@ func searchForAdjacentSpines(spines []Spine, fragments []OCRFragment, start int,
 	// This doesn't give us permutations such as A E - B C D - for that we need to permute the order in which we
 	// join the spines, which is searchPermutedSpines
 	//
-	// We can't really parallelise this easily since we are looking at multiple spines.  So process
-	// the results as they arrive.
-	// TODO Bet we could, though.
-	found := false
+	// Each window is searched on its own copy of the shelf, so we can do them all at once.  Windows which overlap
+	// can't both be right; we keep the most confident and merge the winners into the real shelf afterwards.
+	id.clearResults()
+	starts := []int{}
 
-	sugar.Debugf("Before adjacent merge %+v", spines)
-	healed := ""
+	for start := 0; start+length <= len(spines); start++ {
+		available := len(spines[start].Spine) > 0
 
-	for spineindex := start; spineindex < start+length; spineindex++ {
-		healed += " " + spines[spineindex].Spine
+		for next := start; next < start+length; next++ {
+			if len(spines[next].Author) > 0 || !sameShelf(spines, start, next) {
+				available = false
+			}
+		}
+
+		if available {
+			starts = append(starts, start)
+		}
+	}
+
+	if len(starts) == 0 {
+		return spines, fragments, false
+	}
+
+	// Share the workers out between the windows in flight.
+	concurrency := id.Concurrency
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	perwindow := concurrency / len(starts)
+
+	if perwindow < 1 {
+		perwindow = 1
+	}
+
+	windows := make([]*adjacentWindow, len(starts))
+	limit := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for n, start := range starts {
+		wg.Add(1)
+		limit <- struct{}{}
+
+		go func(n int, start int) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			windows[n] = id.searchAdjacentWindow(ctx, spines, fragments, start, length, phase, perwindow)
+		}(n, start)
+	}
+
+	wg.Wait()
+
+	chosen := chooseWindows(windows)
+
+	if len(chosen) == 0 {
+		return spines, fragments, false
+	}
+
+	// Merge from the right, so that the starts of the windows to the left stay put.
+	sort.Slice(chosen, func(a, b int) bool {
+		return chosen[a].start > chosen[b].start
+	})
+
+	for _, w := range chosen {
+		sugar.Debugf("Use adjacent window at %d length %d score %d", w.start, w.length, w.score)
+		comspined := spines[w.start]
+		comspined.Spine = joinSpines(spines, w.start, w.length)
+		spines, fragments = mergeSpines(spines, fragments, comspined, w.start, w.length-1)
+	}
+
+	// Each window has now moved left by the spines merged away to its left.
+	for _, w := range chosen {
+		shift := 0
+
+		for _, other := range chosen {
+			if other.start < w.start {
+				shift += other.length - 1
+			}
+		}
+
+		for _, result := range w.candidates {
+			result.spineindex -= shift
+			result.firstspine -= shift
+			id.addResult(result)
+		}
+	}
+
+	spines, fragments = id.processSearchResults(spines, fragments, phase)
+	sugar.Debugf("Spines after adjacent %+v", spines)
+
+	return spines, fragments, true
+}
+
+// Search one window of adjacent spines joined together, on copies so that the real ones aren't touched.  Returns nil
+// if we didn't find anything.
+func (id *Identifier) searchAdjacentWindow(ctx context.Context, spines []Spine, fragments []OCRFragment, start int, length int, phase phase, concurrency int) *adjacentWindow {
+	if ctx.Err() != nil || id.searchFailed() {
+		return nil
 	}
 
-	sugar.Debugf("Merge adjacent text %s", healed)
 	newspines := make([]Spine, len(spines))
 	copy(newspines, spines)
-	newspines[start].Spine = healed
+	newspines[start].Spine = joinSpines(spines, start, length)
 	newfragments := make([]OCRFragment, len(fragments))
 	copy(newfragments, fragments)
+	sugar.Debugf("Merge adjacent text %s", newspines[start].Spine)
 
 	newspines, newfragments = mergeSpines(newspines, newfragments, newspines[start], start, length-1)
-	sugar.Debugf("After adjacent merge %+v", newspines)
-
-	// Search using this set of spines to see if we find something.
-	clearResults()
-	searchSpines(newspines, newfragments, phase, start, 1)
-
-	if len(searchResults) > 0 {
-		// We found something.  Use this set.
-		sugar.Debugf("Found an adjacent result - use this set")
-		sugar.Debugf("Spines before %+v", spines)
-		spines = newspines
-		fragments = newfragments
-		sugar.Debugf("Spines after %+v", spines)
-		spines, fragments = processSearchResults(spines, fragments)
-		sugar.Debugf("Spines process %+v", spines)
-		found = true
+
+	child := id.fork()
+	child.Concurrency = concurrency
+	child.searchSpines(ctx, newspines, newfragments, phase, start, 1)
+
+	if len(child.errors) > 0 {
+		id.mux.Lock()
+		id.errors = append(id.errors, child.errors...)
+		id.mux.Unlock()
 	}
 
-	return spines, fragments, found
+	if len(child.candidates[start]) == 0 {
+		return nil
+	}
+
+	w := &adjacentWindow{
+		start:      start,
+		length:     length,
+		candidates: child.candidates[start],
+	}
+
+	for _, result := range w.candidates {
+		if c := result.confidence(phase); c > w.score {
+			w.score = c
+		}
+	}
+
+	sugar.Debugf("Found an adjacent result at %d length %d score %d", start, length, w.score)
+
+	return w
 }
 
-func searchForPermutedSpines(spines []Spine, fragments []OCRFragment, start int, length int, phase phase) ([]Spine, []OCRFragment, bool) {
+// The windows to use - most confident first, leftmost if it's a tie, and none overlapping.
+func chooseWindows(windows []*adjacentWindow) []*adjacentWindow {
+	found := []*adjacentWindow{}
+
+	for _, w := range windows {
+		if w != nil {
+			found = append(found, w)
+		}
+	}
+
+	sort.SliceStable(found, func(a, b int) bool {
+		if found[a].score != found[b].score {
+			return found[a].score > found[b].score
+		}
+
+		return found[a].start < found[b].start
+	})
+
+	chosen := []*adjacentWindow{}
+
+	for _, w := range found {
+		overlaps := false
+
+		for _, c := range chosen {
+			if w.overlaps(c) {
+				overlaps = true
+			}
+		}
+
+		if !overlaps {
+			chosen = append(chosen, w)
+		}
+	}
+
+	return chosen
+}
+
+func (id *Identifier) searchForPermutedSpines(ctx context.Context, spines []Spine, fragments []OCRFragment, start int, length int, phase phase) ([]Spine, []OCRFragment, bool) {
 	// We want to join adjacent spines to see if we can find a match that way.
 	//
 	// Because we search on normalised values, which include sorting, then by joining a spine we automatically get
@@ -949,74 +1384,108 @@ func searchForPermutedSpines(spines []Spine, fragments []OCRFragment, start int,
 	// ...etc
 	//
 	// This doesn't give us permutations such as A E - B C D - for that we'd need to permute the spines rather
-	// than join adjacent ones.
+	// than join adjacent ones, which is what we do here.
 	//
-	// We can't really parallelise this easily since we are looking at multiple spines.  So process
-	// the results as they arrive.
-	// TODO Bet we could, though.
+	// There are length! orders, so we build them up a spine at a time and drop whole branches where we can: the
+	// spine at the author end has to look like an author, and spines with the same text give the same orders.  We
+	// stop at the first order that finds something, or when we run out of budget or time.
 	found := false
-	seq := make([]int, length)
+	seen := map[string]bool{}
+	order := make([]int, 0, length)
+	used := make([]bool, length)
+
+	try := func() {
+		// Generate a set of spines and fragments which match this permutation.  The order is built from the author
+		// end, so if the author comes last it's backwards.
+		texts := make([]string, len(order))
+
+		for n, ent := range order {
+			if phase.authorstart {
+				texts[n] = spines[ent].Spine
+			} else {
+				texts[len(order)-1-n] = spines[ent].Spine
+			}
+		}
 
-	for i := range seq {
-		seq[i] = i + start
-	}
+		healedtext := " " + strings.Join(texts, " ")
 
-	orders := permutations(seq)
-	done := false
+		if seen[healedtext] {
+			return
+		}
 
-	for _, order := range orders {
-		if !done {
-			// Generate a set of spines and fragments which match this permutation.
-			sugar.Debugf("Consider permutation %+v", order)
-			healedtext := ""
+		seen[healedtext] = true
+		sugar.Debugf("Consider permutation %+v healed text %s", order, healedtext)
 
-			for _, ent := range order {
-				healedtext += " " + spines[ent].Spine
-			}
+		// Now use this text and drop the others.  If we find results then these spines and fragments will become our
+		// actual versions.
+		//
+		// Need to clone as slices are passed by reference (effectively).
+		newspines := make([]Spine, len(spines))
+		newfragments := make([]OCRFragment, len(fragments))
+		copy(newspines, spines)
+		copy(newfragments, fragments)
+		newspines[start].Spine = healedtext
+		newspines, newfragments = mergeSpines(newspines, newfragments, newspines[start], start, length-1)
+
+		// Search using this set of spines to see if we find something.
+		id.clearResults()
+		id.permuted += id.searchSpines(ctx, newspines, newfragments, phase, start, 1)
+
+		if id.resultCount() > 0 {
+			// We found something.  Use this set.
+			// TODO Different permutations might find better results than others?
+			sugar.Debugf("Found a permuted result - use this set")
+			sugar.Debugf("Spines before %+v", spines)
+			spines = newspines
+			fragments = newfragments
+			sugar.Debugf("Spines after %+v", spines)
+			spines, fragments = id.processSearchResults(spines, fragments, phase)
+			sugar.Debugf("Spines process %+v", spines)
+			found = true
+		}
+	}
 
-			sugar.Debugf("Healed text %s", healedtext)
+	var permute func()
+	permute = func() {
+		if len(order) == length {
+			try()
+			return
+		}
 
-			// Now use this text and drop the others.  If we find results then these spines and fragments will become our
-			// actual versions.
-			//
-			// Need to clone as slices are passed by reference (effectively).
-			newspines := make([]Spine, len(spines))
-			newfragments := make([]OCRFragment, len(fragments))
-			copy(newspines, spines)
-			copy(newfragments, fragments)
-			newspines[start].Spine = healedtext
-			newspines, newfragments = mergeSpines(newspines, newfragments, newspines[start], start, length-1)
-
-			// Search using this set of spines to see if we find something.
-			clearResults()
-			searchSpines(newspines, newfragments, phase, start, 1)
-
-			if len(searchResults) > 0 {
-				// We found something.  Use this set.
-				// TODO Different permutations might find better results than others?
-				sugar.Debugf("Found a permuted result - use this set")
-				sugar.Debugf("Spines before %+v", spines)
-				spines = newspines
-				fragments = newfragments
-				sugar.Debugf("Spines after %+v", spines)
-				spines, fragments = processSearchResults(spines, fragments)
-				sugar.Debugf("Spines process %+v", spines)
-				done = true
-				found = true
+		tried := map[string]bool{}
+
+		for n := 0; n < length && !found && ctx.Err() == nil && !id.searchFailed() && id.permuteBudgetLeft(); n++ {
+			text := spines[start+n].Spine
+
+			if used[n] || tried[text] || (len(order) == 0 && !id.plausibleAuthor(text)) {
+				continue
 			}
+
+			tried[text] = true
+			used[n] = true
+			order = append(order, start+n)
+			permute()
+			order = order[0 : len(order)-1]
+			used[n] = false
 		}
 	}
 
+	permute()
+
+	if !id.permuteBudgetLeft() {
+		sugar.Infof("Permuted search budget of %d used up at phase %d start %d length %d", id.PermuteBudget, phase.id, start, length)
+	}
+
 	return spines, fragments, found
 }
 
-func searchForMangledSpines(spines []Spine, fragments []OCRFragment, start int, length int, phase phase) ([]Spine, []OCRFragment, bool) {
+func (id *Identifier) searchForMangledSpines(ctx context.Context, spines []Spine, fragments []OCRFragment, start int, length int, phase phase) ([]Spine, []OCRFragment, bool) {
 	// More rarely Google breaks in the wrong place.  So now we want to ignore where Google has broken.  Split each of
 	// these spines into single-word spines so that we can then permute them.
 	//
 	// Need to clone as slices are passed by reference (effectively).
 	sugar.Debugf("Mangled spine pre-split into words %+v", spines)
-	found := false
+	var found bool
 	newspines := []Spine{}
 
 	if start > 0 {
@@ -1034,6 +1503,7 @@ func searchForMangledSpines(spines []Spine, fragments []OCRFragment, start int,
 				Spine:  word,
 				Author: "",
 				Title:  "",
+				Shelf:  spines[spineindex].Shelf,
 			})
 		}
 	}
@@ -1047,23 +1517,19 @@ func searchForMangledSpines(spines []Spine, fragments []OCRFragment, start int,
 
 	added := len(newspines) - len(spines)
 
-	// We can only afford to search permutations upto a certain length, as it's factorial.
-	if added+length < 4 {
+	// We can only afford to search permutations upto a certain length, as it's factorial.  The budget and the pruning
+	// in searchForPermutedSpines keep this under control.
+	if added+length <= MANGLED_MAX_WORDS {
 		// We've added some spines in this process.  We need to renumber the fragments, which is a bit of a faff.
-		newlines := []string{}
-		for _, spine := range newspines {
-			newlines = append(newlines, spine.Spine)
-		}
-
 		newfragments := make([]OCRFragment, len(fragments))
 		copy(newfragments, fragments)
-		newfragments = AddSpineIndex(newlines, newfragments)
+		newfragments = splitFragments(newspines, newfragments, start, length, added)
 
 		sugar.Debugf("Mangled spine post-split into words added %d spines %+v", added, newspines)
 
 		// Now we search for permutations of these new spines.
 		sugar.Infof("Mangled spine search phase %d start %d length %d added %d - start", phase.id, start, length, added)
-		newspines, newfragments, found := searchForPermutedSpines(newspines, newfragments, start, length+added, phase)
+		newspines, newfragments, found = id.searchForPermutedSpines(ctx, newspines, newfragments, start, length+added, phase)
 		sugar.Infof("Mangled spine search phase %d start %d length %d added %d - end %t", phase.id, start, length, added, found)
 
 		if found {
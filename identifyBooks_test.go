@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -94,6 +96,54 @@ var tests = []string{
 	"horizontal_overlap2",
 }
 
+// By default we replay the Elasticsearch responses recorded in testdata, so that we don't need a cluster.  Set
+// BOOKTASTIC_FIXTURES=record to re-record them against a live cluster, or live to use one without recording.  A
+// missing fixture is a failure, as otherwise the test quietly checks nothing; set BOOKTASTIC_FIXTURES=skip to skip
+// those cases instead.
+func useFixture(t *testing.T, fn string) (Catalogue, func()) {
+	ffn := "testdata" + string(filepath.Separator) + fn + ".es.json"
+	cfg := defaultElasticConfig()
+
+	if err := cfg.fromEnv(); err != nil {
+		t.Fatalf("Bad config: %s", err)
+	}
+
+	switch os.Getenv("BOOKTASTIC_FIXTURES") {
+	case "live":
+		c, err := newElasticCatalogue(cfg)
+
+		if err != nil {
+			t.Fatalf("No catalogue: %s", err)
+		}
+
+		return c, func() {}
+	case "record":
+		c, err := newElasticFixtureCatalogue(ffn, true, cfg)
+
+		if err != nil {
+			t.Fatalf("No catalogue: %s", err)
+		}
+
+		return c, func() {
+			if err := c.fixture.Save(); err != nil {
+				t.Errorf("Failed to save fixture %s: %s", ffn, err)
+			}
+		}
+	default:
+		c, err := newElasticFixtureCatalogue(ffn, false, cfg)
+
+		if err != nil {
+			if os.Getenv("BOOKTASTIC_FIXTURES") == "skip" {
+				t.Skipf("No fixture %s - record with BOOKTASTIC_FIXTURES=record", ffn)
+			}
+
+			t.Fatalf("No fixture %s - record with BOOKTASTIC_FIXTURES=record: %s", ffn, err)
+		}
+
+		return c, func() {}
+	}
+}
+
 func runTest(t *testing.T, tests []string) {
 	// Run our tests.
 	failed := false
@@ -101,6 +151,9 @@ func runTest(t *testing.T, tests []string) {
 	for _, fn := range tests {
 		t.Run(fn, func(t *testing.T) {
 			sugar.Infof("Run test %s", fn)
+			c, done := useFixture(t, fn)
+			defer done()
+
 			ifn := "testdata" + string(filepath.Separator) + fn + ".json"
 			data, _ := ioutil.ReadFile(ifn)
 			spines := []Spine{}
@@ -109,7 +162,9 @@ func runTest(t *testing.T, tests []string) {
 
 			if len(lines) > 0 && len(fragments) > 0 {
 				spines, fragments = ExtractSpines(lines, fragments)
-				spines, fragments = IdentifyBooks(spines, fragments)
+				var err error
+				spines, fragments, err = NewIdentifier(c).IdentifyBooks(context.Background(), spines, fragments)
+				assert.Nil(t, err)
 
 				sugar.Debugf("Spines after test %+v", spines)
 
@@ -215,3 +270,220 @@ func TestOne(t *testing.T) {
 		"liz8",
 	})
 }
+
+func TestConfidence(t *testing.T) {
+	exact := searchResult{authorScore: 100, titleScore: 100, strategy: MATCH_AUTHOR_TITLE}
+	borderline := searchResult{authorScore: CONFIDENCE, titleScore: CONFIDENCE, strategy: MATCH_TITLE}
+
+	assert.Equal(t, 100, exact.confidence(phase{}))
+	assert.True(t, exact.confidence(phase{mangled: true}) < exact.confidence(phase{adjacent: true}))
+	assert.True(t, borderline.confidence(phase{}) < CONFIDENCE)
+
+	known := searchResult{authorScore: HIGHCONFIDENCE, titleScore: HIGHCONFIDENCE, strategy: MATCH_KNOWN_AUTHOR}
+	assert.True(t, known.confidence(phase{}) < exact.confidence(phase{}))
+}
+
+// A catalogue which only finds books when it's asked for exactly the right author and title.
+type exactCatalogue struct {
+	stubCatalogue
+}
+
+func (c *exactCatalogue) find(author string, title string) ([]Work, error) {
+	for _, work := range c.works {
+		if work.NormalAuthor == author && work.NormalTitle == title {
+			return []Work{work}, nil
+		}
+	}
+
+	return []Work{}, nil
+}
+
+func (c *exactCatalogue) SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.find(author, title)
+}
+
+func (c *exactCatalogue) SearchTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.find(author, title)
+}
+
+func (c *exactCatalogue) SearchAuthorTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	return c.find(author, title)
+}
+
+func TestPermutedSpines(t *testing.T) {
+	c := &exactCatalogue{stubCatalogue{works: []Work{
+		{Author: "Edward Marston", Title: "Dance of Death", NormalAuthor: "edward marston", NormalTitle: "dance death", VIAF: "1"},
+		{Author: "Stephen King", Title: "The Dark Tower", NormalAuthor: "stephen king", NormalTitle: "dark tower", VIAF: "2"},
+	}}}
+
+	// The title is split either side of the author, so only reordering the spines can find it.
+	shelf := func() []Spine {
+		return []Spine{
+			{Spine: "EDWARD MARSTON DANCE OF DEATH"},
+			{Spine: "TOWER"},
+			{Spine: "STEPHEN KING"},
+			{Spine: "DARK"},
+		}
+	}
+
+	identifier := NewIdentifier(c)
+	spines, _, err := identifier.IdentifyBooks(context.Background(), shelf(), []OCRFragment{})
+	assert.Nil(t, err)
+	assert.Equal(t, "Edward Marston", spines[0].Author)
+	assert.Equal(t, 2, len(spines))
+	assert.Equal(t, "The Dark Tower", spines[1].Title)
+	assert.True(t, identifier.permuted > 0 && identifier.permuted <= PERMUTE_BUDGET)
+
+	// Without a budget we don't try.
+	identifier = NewIdentifier(c)
+	identifier.PermuteBudget = 0
+	spines, _, err = identifier.IdentifyBooks(context.Background(), shelf(), []OCRFragment{})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(spines))
+	assert.Equal(t, 0, identifier.permuted)
+
+	// And the budget is a limit.
+	identifier = NewIdentifier(c)
+	identifier.PermuteBudget = 3
+	_, _, _ = identifier.IdentifyBooks(context.Background(), shelf(), []OCRFragment{})
+	assert.True(t, identifier.permuted <= 3+len(shelf()))
+}
+
+func TestBrokenSpineAtEnd(t *testing.T) {
+	c := &exactCatalogue{stubCatalogue{works: []Work{
+		{Author: "Stephen King", Title: "The Dark Tower", NormalAuthor: "stephen king", NormalTitle: "dark tower", VIAF: "2"},
+	}}}
+
+	var permuted phase
+
+	for _, p := range setUpPhases() {
+		if p.permuted && p.authorstart {
+			permuted = p
+			break
+		}
+	}
+
+	// The only window which finds it is the whole shelf, ending at the last spine.
+	identifier := NewIdentifier(c)
+	identifier.clearResults()
+	spines, _ := identifier.searchBrokenSpines(context.Background(), []Spine{
+		{Spine: "TOWER"},
+		{Spine: "STEPHEN KING"},
+		{Spine: "DARK"},
+	}, []OCRFragment{}, permuted)
+
+	assert.Equal(t, 1, len(spines))
+	assert.Equal(t, "The Dark Tower", spines[0].Title)
+}
+
+func TestMangledSpines(t *testing.T) {
+	c := &exactCatalogue{stubCatalogue{works: []Work{
+		{Author: "Stephen King", Title: "The Dark Tower", NormalAuthor: "stephen king", NormalTitle: "dark tower", VIAF: "2"},
+	}}}
+
+	// The words are split across the spines in the wrong places, so only splitting them up and reordering the words
+	// can find it.
+	var mangled phase
+
+	for _, p := range setUpPhases() {
+		if p.mangled && p.authorstart {
+			mangled = p
+			break
+		}
+	}
+
+	identifier := NewIdentifier(c)
+	identifier.clearResults()
+	spines, _, found := identifier.searchForMangledSpines(context.Background(), []Spine{
+		{Spine: "TOWER KING"},
+		{Spine: "STEPHEN DARK"},
+	}, []OCRFragment{}, 0, 2, mangled)
+
+	assert.True(t, found)
+	assert.Equal(t, 1, len(spines))
+	assert.Equal(t, "The Dark Tower", spines[0].Title)
+}
+
+func TestPlausibleAuthor(t *testing.T) {
+	identifier := NewIdentifier(&stubCatalogue{})
+	assert.True(t, identifier.plausibleAuthor("STEPHEN KING"))
+	assert.False(t, identifier.plausibleAuthor("1984"))
+	assert.False(t, identifier.plausibleAuthor("THE"))
+
+	// Once we know the words, a publisher won't do.
+	identifier.Dictionary = testDictionary()
+	assert.True(t, identifier.plausibleAuthor("STEPHEN KING"))
+	assert.True(t, identifier.plausibleAuthor("STEPHEM"))
+	assert.False(t, identifier.plausibleAuthor("VINTAGE"))
+}
+
+func TestSplitFragments(t *testing.T) {
+	// "STEPHEN KING" at 1 has been split into two spines, and "DARK" has moved up.
+	spines := []Spine{{Spine: "VINTAGE"}, {Spine: "KING"}, {Spine: "STEPHEN"}, {Spine: "DARK"}}
+	fragments := []OCRFragment{
+		{Description: "VINTAGE", SpineIndex: 0},
+		{Description: "Stephen", SpineIndex: 1},
+		{Description: "KING", SpineIndex: 1},
+		{Description: "©", SpineIndex: 1},
+		{Description: "DARK", SpineIndex: 2},
+	}
+
+	fragments = splitFragments(spines, fragments, 1, 1, 1)
+	indexes := []int{}
+
+	for _, frag := range fragments {
+		indexes = append(indexes, frag.SpineIndex)
+	}
+
+	assert.Equal(t, []int{0, 2, 1, 1, 3}, indexes)
+}
+
+func TestAdjacentSpines(t *testing.T) {
+	c := &exactCatalogue{stubCatalogue{works: []Work{
+		{Author: "Edward Marston", Title: "Dance of Death", NormalAuthor: "edward marston", NormalTitle: "dance death", VIAF: "1"},
+		{Author: "Stephen King", Title: "The Dark Tower", NormalAuthor: "stephen king", NormalTitle: "dark tower", VIAF: "2"},
+		{Author: "Iris Murdoch", Title: "The Black Prince", NormalAuthor: "iris murdoch", NormalTitle: "black prince", VIAF: "3"},
+	}}}
+
+	identifier := NewIdentifier(c)
+	identifier.PermuteBudget = 0
+	spines, fragments, err := identifier.IdentifyBooks(context.Background(), []Spine{
+		{Spine: "EDWARD MARSTON DANCE OF DEATH"},
+		{Spine: "STEPHEN KING"},
+		{Spine: "DARK TOWER"},
+		{Spine: "IRIS MURDOCH"},
+		{Spine: "BLACK PRINCE"},
+	}, []OCRFragment{
+		{Description: "KING", SpineIndex: 1},
+		{Description: "IRIS", SpineIndex: 3},
+		{Description: "PRINCE", SpineIndex: 4},
+	})
+
+	// Both books are found, and the fragments follow them.
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(spines))
+	assert.Equal(t, "The Dark Tower", spines[1].Title)
+	assert.Equal(t, "The Black Prince", spines[2].Title)
+	assert.Equal(t, 1, fragments[0].SpineIndex)
+	assert.Equal(t, 2, fragments[1].SpineIndex)
+	assert.Equal(t, 2, fragments[2].SpineIndex)
+}
+
+func TestChooseWindows(t *testing.T) {
+	chosen := chooseWindows([]*adjacentWindow{
+		{start: 0, length: 2, score: 80},
+		nil,
+		{start: 1, length: 2, score: 95},
+		{start: 3, length: 3, score: 80},
+		{start: 4, length: 2, score: 80},
+	})
+
+	// The best one wins the overlap, and then leftmost first.
+	starts := []int{}
+
+	for _, w := range chosen {
+		starts = append(starts, w.start)
+	}
+
+	assert.Equal(t, []int{1, 3}, starts)
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"log"
+	"os"
 )
 
 var sugar *zap.SugaredLogger
@@ -19,18 +21,94 @@ func init() {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// The work of main, returning the exit code.  os.Exit doesn't run deferred calls, so we only call it once everything
+// here has been tidied up.
+func run() int {
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		// Build the catalogue index from a dump.
+		if err := indexCommand(os.Args[2:]); err != nil {
+			fmt.Println("Index failed:", err)
+			return 1
+		}
+
+		return 0
+	}
+
 	verbosePtr := flag.Bool("v", false, "Debug logging")
 	inputPtr := flag.String("i", "", "Input file")
 	outputPtr := flag.String("o", "", "Output file")
+	cataloguePtr := flag.String("c", "", "Work list (JSON lines or CSV) to search instead of Elasticsearch")
+	budgetPtr := flag.Duration("t", 0, "Time budget for identifying the books in the image, e.g. 60s")
+	concurrencyPtr := flag.Int("j", SEARCH_CONCURRENCY, "Most catalogue searches to run at once")
+	candidatesPtr := flag.Int("n", MAXCANDIDATES, "Most candidate books to report per spine")
+	globalPtr := flag.Bool("g", false, "Choose between candidates across the whole shelf")
+	permutePtr := flag.Int("p", PERMUTE_BUDGET, "Most searches for reordered spines per image, 0 to turn them off")
+	segmentPtr := flag.String("s", SEGMENT_LINES, "How to split the text into spines: lines (from the OCR summary) or geometry (from where the words are)")
+	shelvesPtr := flag.Bool("r", false, "Split the photo into shelves (rows) before finding spines")
+	dictionaryPtr := flag.String("d", "", "Word list written by the index command, for correcting OCR mistakes")
+	esFlags := addElasticFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	if *segmentPtr != SEGMENT_LINES && *segmentPtr != SEGMENT_GEOMETRY {
+		fmt.Println("Unknown segmentation", *segmentPtr)
+		return 1
+	}
+
 	if !*verbosePtr {
 		// Turn off logging.
 		log.SetOutput(ioutil.Discard)
 		log.SetFlags(0)
 	}
 
+	var catalogue Catalogue
+	var dict *dictionary
+
+	if len(*cataloguePtr) > 0 {
+		c, err := LoadMemoryCatalogue(*cataloguePtr)
+
+		if err != nil {
+			fmt.Println("Failed to load catalogue:", err)
+			return 1
+		}
+
+		catalogue = c
+		dict = c.dictionary()
+	} else if len(*inputPtr) > 0 {
+		cfg, err := esFlags.resolve()
+		var c *elasticCatalogue
+
+		if err == nil {
+			c, err = newElasticCatalogue(cfg)
+		}
+
+		if err == nil {
+			err = c.ping(context.Background())
+		}
+
+		if err != nil {
+			fmt.Println("Elasticsearch unavailable:", err)
+			return 1
+		}
+
+		defer c.Close()
+		catalogue = c
+	}
+
+	if len(*dictionaryPtr) > 0 {
+		d, err := loadDictionary(*dictionaryPtr)
+
+		if err != nil {
+			fmt.Println("Failed to load dictionary:", err)
+			return 1
+		}
+
+		dict = d
+	}
+
 	if len(*inputPtr) > 0 && len(*outputPtr) > 0 {
 		data, _ := ioutil.ReadFile(*inputPtr)
 
@@ -38,25 +116,71 @@ func main() {
 		fragments := []OCRFragment{}
 
 		lines, fragments := GetLinesAndFragments(string(data))
+		var err error
+
+		if *segmentPtr == SEGMENT_GEOMETRY {
+			lines, fragments = SegmentSpines(fragments)
+		}
+
+		if *shelvesPtr {
+			lines, fragments = ShelveLines(lines, AssignShelves(fragments))
+		}
 
 		if len(fragments) > 0 {
 			spines, fragments = ExtractSpines(lines, fragments)
-			spines, fragments = IdentifyBooks(spines, fragments)
+			ctx := context.Background()
+
+			if *budgetPtr > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, *budgetPtr)
+				defer cancel()
+			}
+
+			identifier := NewIdentifier(catalogue)
+			identifier.Concurrency = *concurrencyPtr
+			identifier.MaxCandidates = *candidatesPtr
+			identifier.Global = *globalPtr
+			identifier.Dictionary = dict
+			identifier.PermuteBudget = *permutePtr
+			spines, fragments, err = identifier.IdentifyBooks(ctx, spines, fragments)
+
+			if c, ok := catalogue.(*elasticCatalogue); ok {
+				sugar.Infof("Catalogue searches %+v", c.Stats())
+			}
 		}
 
 		type output struct {
 			Spines    []Spine       `json:"spines"`
 			Fragments []OCRFragment `json:"fragments"`
+			Partial   bool          `json:"partial"`
+			Errors    []string      `json:"errors,omitempty"`
 		}
 
 		outputVal := output{
 			Spines:    spines,
 			Fragments: fragments,
+			Partial:   err != nil,
+		}
+
+		if serr, ok := err.(*SearchError); ok {
+			// We still write out what we managed, along with what went wrong.
+			for _, e := range serr.Errors {
+				outputVal.Errors = append(outputVal.Errors, e.Error())
+			}
+		} else if err != nil {
+			outputVal.Errors = append(outputVal.Errors, err.Error())
 		}
 
 		Encoded, _ := json.MarshalIndent(outputVal, "", " ")
 		_ = ioutil.WriteFile(*outputPtr, Encoded, 0644)
+
+		if err != nil {
+			fmt.Println("Identification incomplete:", err)
+			return 1
+		}
 	} else {
 		fmt.Println("No files given")
 	}
+
+	return 0
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/agnivade/levenshtein"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This mirrors the fuzziness we use in the Elasticsearch queries.
+const MEMORY_FUZZINESS = 2
+
+// An in-process catalogue, for when we don't have an Elasticsearch cluster to hand.  It's a linear scan over the
+// distinct authors or titles, so it's fine for a laptop-sized work list but not for the whole of VIAF.
+type memoryCatalogue struct {
+	works  []Work
+	author map[string][]int
+	title  map[string][]int
+	viaf   map[string][]int
+}
+
+func newMemoryCatalogue(works []Work) *memoryCatalogue {
+	c := &memoryCatalogue{
+		works:  works,
+		author: map[string][]int{},
+		title:  map[string][]int{},
+		viaf:   map[string][]int{},
+	}
+
+	for i, work := range works {
+		c.author[work.NormalAuthor] = append(c.author[work.NormalAuthor], i)
+		c.title[work.NormalTitle] = append(c.title[work.NormalTitle], i)
+		c.viaf[work.VIAF] = append(c.viaf[work.VIAF], i)
+	}
+
+	return c
+}
+
+// LoadMemoryCatalogue reads a work list from a file.  Files ending .csv are CSV with a header row naming the fields;
+// anything else is taken to be JSON lines.
+func LoadMemoryCatalogue(filename string) (*memoryCatalogue, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	works := []Work{}
+	err = readWorks(f, workFormat(filename), func(work Work) error {
+		works = append(works, work)
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	sugar.Infof("Loaded %d works from %s", len(works), filename)
+
+	return newMemoryCatalogue(works), nil
+}
+
+// The vocabulary of the works we hold.
+func (c *memoryCatalogue) dictionary() *dictionary {
+	d := newDictionary()
+
+	for _, work := range c.works {
+		d.add(work)
+	}
+
+	return d
+}
+
+func workFormat(filename string) string {
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		return "csv"
+	}
+
+	return "jsonl"
+}
+
+// Read works in the same shape as the Elasticsearch index.  If the normalised fields are missing we compute them, so
+// that a plain author/title list is enough.
+func readWorks(r io.Reader, format string, fn func(Work) error) error {
+	emit := func(work Work) error {
+		if len(work.NormalAuthor) == 0 {
+			work.NormalAuthor = NormalizeAuthor(work.Author)
+		}
+
+		if len(work.NormalTitle) == 0 {
+			work.NormalTitle = NormalizeTitle(work.Title)
+		}
+
+		return fn(work)
+	}
+
+	switch format {
+	case "csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+
+		if err != nil {
+			return err
+		}
+
+		for {
+			record, err := reader.Read()
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			source := map[string]interface{}{}
+
+			for i, name := range header {
+				if i < len(record) {
+					source[strings.TrimSpace(name)] = record[i]
+				}
+			}
+
+			if err := emit(workFromSource(source)); err != nil {
+				return err
+			}
+		}
+	case "jsonl":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		line := 0
+
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+
+			if len(text) > 0 {
+				var source map[string]interface{}
+				dec := json.NewDecoder(strings.NewReader(text))
+				dec.UseNumber()
+
+				if err := dec.Decode(&source); err != nil {
+					return fmt.Errorf("line %d: %s", line, err)
+				}
+
+				if err := emit(workFromSource(source)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return scanner.Err()
+	default:
+		return fmt.Errorf("unknown work list format %s", format)
+	}
+
+	return nil
+}
+
+type memoryMatch struct {
+	index int
+	score int
+}
+
+// Find the works whose value for a field is within our fuzziness of the one we want.  Lower scores are better.
+func fuzzyMatches(values map[string][]int, value string) []memoryMatch {
+	matches := []memoryMatch{}
+
+	for candidate, indices := range values {
+		diff := len(candidate) - len(value)
+
+		if diff <= MEMORY_FUZZINESS && diff >= -MEMORY_FUZZINESS {
+			dist := levenshtein.ComputeDistance(value, candidate)
+
+			if dist <= MEMORY_FUZZINESS {
+				for _, index := range indices {
+					matches = append(matches, memoryMatch{
+						index: index,
+						score: dist,
+					})
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+func (c *memoryCatalogue) ranked(matches []memoryMatch, size int) []Work {
+	// Best score first, then the better known work; otherwise keep the order of the work list so that results are
+	// repeatable.
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score < matches[j].score
+		}
+
+		if c.works[matches[i].index].Popularity != c.works[matches[j].index].Popularity {
+			return c.works[matches[i].index].Popularity > c.works[matches[j].index].Popularity
+		}
+
+		return matches[i].index < matches[j].index
+	})
+
+	works := []Work{}
+
+	for i := 0; i < len(matches) && i < size; i++ {
+		works = append(works, c.works[matches[i].index])
+	}
+
+	return works
+}
+
+func (c *memoryCatalogue) SearchAuthor(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	matches := fuzzyMatches(c.author, author)
+
+	for i, match := range matches {
+		// An exact title match is a "should" - it ranks ahead of anything it doesn't match.
+		if c.works[match.index].NormalTitle != title {
+			matches[i].score += MEMORY_FUZZINESS + 1
+		}
+	}
+
+	return c.ranked(matches, size), nil
+}
+
+func (c *memoryCatalogue) SearchTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	matches := fuzzyMatches(c.title, title)
+
+	for i, match := range matches {
+		if c.works[match.index].NormalAuthor != author {
+			matches[i].score += MEMORY_FUZZINESS + 1
+		}
+	}
+
+	return c.ranked(matches, size), nil
+}
+
+func (c *memoryCatalogue) SearchAuthorTitle(ctx context.Context, author string, title string, size int) ([]Work, error) {
+	matches := []memoryMatch{}
+
+	for _, match := range fuzzyMatches(c.author, author) {
+		dist := levenshtein.ComputeDistance(title, c.works[match.index].NormalTitle)
+
+		if dist <= MEMORY_FUZZINESS {
+			match.score += dist
+			matches = append(matches, match)
+		}
+	}
+
+	return c.ranked(matches, size), nil
+}
+
+func (c *memoryCatalogue) WorksByVIAF(ctx context.Context, viafid string, size int) ([]Work, error) {
+	matches := []memoryMatch{}
+
+	if len(viafid) == 0 {
+		return []Work{}, nil
+	}
+
+	for _, index := range c.viaf[viafid] {
+		matches = append(matches, memoryMatch{
+			index: index,
+		})
+	}
+
+	return c.ranked(matches, size), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const WORKS_JSONL = `{"author": "Edward Marston", "title": "Dance of Death", "normalauthor": "edward marston", "normaltitle": "dance death", "viafid": 12345}
+{"author": "Edward Marston", "title": "Deeds of Darkness", "viafid": "12345"}
+
+{"author": "Henning Mankell", "title": "The Fifth Woman", "viafid": "67890"}
+`
+
+const WORKS_CSV = `author,title,viafid
+Henning Mankell,Before the Frost,67890
+"Mansell, Jill",Thinking of You,11111
+`
+
+func loadTestWorks(t *testing.T, data string, format string) []Work {
+	works := []Work{}
+	err := readWorks(strings.NewReader(data), format, func(work Work) error {
+		works = append(works, work)
+		return nil
+	})
+
+	assert.Nil(t, err)
+
+	return works
+}
+
+func TestReadWorks(t *testing.T) {
+	works := loadTestWorks(t, WORKS_JSONL, "jsonl")
+	assert.Equal(t, 3, len(works))
+	assert.Equal(t, "12345", works[0].VIAF)
+	assert.Equal(t, "deeds darkness", works[1].NormalTitle)
+	assert.Equal(t, "henning mankell", works[2].NormalAuthor)
+
+	works = loadTestWorks(t, WORKS_CSV, "csv")
+	assert.Equal(t, 2, len(works))
+	assert.Equal(t, "before frost", works[0].NormalTitle)
+	assert.Equal(t, "mansell jill", works[1].NormalAuthor)
+	assert.Equal(t, "11111", works[1].VIAF)
+
+	assert.NotNil(t, readWorks(strings.NewReader("{"), "jsonl", func(Work) error { return nil }))
+
+	// Real VIAF ids are long enough that they don't survive being a float.
+	works = loadTestWorks(t, `{"author": "Stephen King", "title": "Cell", "viafid": 102333412, "popularity": 12}
+{"author": "Someone", "title": "Something", "viafid": 3614152822004901040008}
+`, "jsonl")
+	assert.Equal(t, "102333412", works[0].VIAF)
+	assert.Equal(t, 12, works[0].Popularity)
+	assert.Equal(t, "3614152822004901040008", works[1].VIAF)
+
+	// And if something's already decoded it as a float, we don't make it worse.
+	assert.Equal(t, "102333412", workFromSource(map[string]interface{}{"viafid": float64(102333412)}).VIAF)
+}
+
+func TestMemoryCatalogue(t *testing.T) {
+	ctx := context.Background()
+	c := newMemoryCatalogue(append(loadTestWorks(t, WORKS_JSONL, "jsonl"), loadTestWorks(t, WORKS_CSV, "csv")...))
+
+	// Fuzzy author, with the exact title ranked first.
+	works, _ := c.SearchAuthor(ctx, "edwerd marstin", "deeds darkness", 10)
+	assert.Equal(t, 2, len(works))
+	assert.Equal(t, "Deeds of Darkness", works[0].Title)
+
+	// Too far away.
+	works, _ = c.SearchAuthor(ctx, "edwardo marstonne", "", 10)
+	assert.Equal(t, 0, len(works))
+
+	works, _ = c.SearchTitle(ctx, "henning mankell", "fifth wuman", 10)
+	assert.Equal(t, 1, len(works))
+	assert.Equal(t, "The Fifth Woman", works[0].Title)
+
+	works, _ = c.SearchAuthorTitle(ctx, "henning mankel", "before frost", 10)
+	assert.Equal(t, 1, len(works))
+	assert.Equal(t, "Before the Frost", works[0].Title)
+
+	works, _ = c.WorksByVIAF(ctx, "67890", 1)
+	assert.Equal(t, 1, len(works))
+	assert.Equal(t, "The Fifth Woman", works[0].Title)
+
+	works, _ = c.WorksByVIAF(ctx, "", 10)
+	assert.Equal(t, 0, len(works))
+}
+
+func TestMemoryCataloguePopularity(t *testing.T) {
+	c := newMemoryCatalogue([]Work{
+		{Author: "Agatha Christie", Title: "Sleeping Murder", NormalAuthor: "christie agatha", NormalTitle: "sleeping murder", VIAF: "1", Popularity: 3},
+		{Author: "Agatha Christie", Title: "Sleeping Murder", NormalAuthor: "christie agatha", NormalTitle: "sleeping murder", VIAF: "1", Popularity: 40},
+	})
+
+	// Equally good matches, so the better known one comes first.
+	works, _ := c.SearchAuthorTitle(context.Background(), "christie agatha", "sleeping murder", 10)
+	assert.Equal(t, 2, len(works))
+	assert.Equal(t, 40, works[0].Popularity)
+}
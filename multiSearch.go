@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long we wait for more searches to arrive before sending a batch.  Searches within a phase are all started at
+// once, so this doesn't need to be long.
+const MSEARCH_WINDOW = 5 * time.Millisecond
+
+// A single image can generate hundreds of searches.  Rather than send each one separately, we collect the ones which
+// arrive together and send them as a single _msearch, then hand each caller back its own response.
+//
+// The collector runs until the searcher is closed.  We signal that with done rather than by closing requests, as a
+// search might be trying to send at the time.
+type multiSearcher struct {
+	c         *elasticCatalogue
+	max       int
+	window    time.Duration
+	requests  chan *msearchRequest
+	done      chan struct{}
+	once      sync.Once
+	closeOnce sync.Once
+}
+
+var errSearcherClosed = errors.New("catalogue closed")
+
+type msearchRequest struct {
+	ctx   context.Context
+	key   string
+	query map[string]interface{}
+	size  int
+	reply chan msearchReply
+}
+
+type msearchReply struct {
+	r   map[string]interface{}
+	err error
+}
+
+func newMultiSearcher(c *elasticCatalogue, max int) *multiSearcher {
+	return &multiSearcher{
+		c:        c,
+		max:      max,
+		window:   MSEARCH_WINDOW,
+		requests: make(chan *msearchRequest),
+		done:     make(chan struct{}),
+	}
+}
+
+// Stop collecting.  Searches already sent carry on, but new ones fail.
+func (m *multiSearcher) close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+}
+
+func (m *multiSearcher) search(ctx context.Context, key string, query map[string]interface{}, size int) (map[string]interface{}, error) {
+	m.once.Do(func() {
+		go m.collect()
+	})
+
+	req := &msearchRequest{
+		ctx:   ctx,
+		key:   key,
+		query: query,
+		size:  size,
+		reply: make(chan msearchReply, 1),
+	}
+
+	select {
+	case m.requests <- req:
+	case <-m.done:
+		return nil, errSearcherClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// If we give up waiting, the reply channel is buffered so the sender won't block.
+	select {
+	case reply := <-req.reply:
+		return reply.r, reply.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *multiSearcher) collect() {
+	for {
+		var first *msearchRequest
+
+		select {
+		case first = <-m.requests:
+		case <-m.done:
+			return
+		}
+
+		batch := []*msearchRequest{first}
+		timer := time.NewTimer(m.window)
+		waiting := true
+
+		for waiting && len(batch) < m.max {
+			select {
+			case req := <-m.requests:
+				batch = append(batch, req)
+			case <-timer.C:
+				waiting = false
+			case <-m.done:
+				// Send what we've got, as those callers are waiting for it.
+				waiting = false
+			}
+		}
+
+		timer.Stop()
+
+		// Send in the background so that we can carry on collecting the next batch.
+		go m.send(batch)
+	}
+}
+
+// Fall back to searching singly, which has its own retries.
+func (m *multiSearcher) single(req *msearchRequest) {
+	r, err := m.c.search(req.ctx, req.key, req.query, req.size)
+	req.reply <- msearchReply{
+		r:   r,
+		err: err,
+	}
+}
+
+func (m *multiSearcher) send(batch []*msearchRequest) {
+	// Don't bother with any whose callers have given up.
+	live := []*msearchRequest{}
+
+	for _, req := range batch {
+		if req.ctx.Err() != nil {
+			req.reply <- msearchReply{
+				err: req.ctx.Err(),
+			}
+		} else {
+			live = append(live, req)
+		}
+	}
+
+	batch = live
+
+	if len(batch) == 0 {
+		return
+	} else if len(batch) == 1 {
+		m.single(batch[0])
+		return
+	}
+
+	sugar.Debugf("MSEARCH: %d searches", len(batch))
+	responses, err := m.msearch(batch)
+
+	if err != nil {
+		// The whole request failed.  Might be transient, might be one bad query; either way the single searches
+		// will sort it out.
+		sugar.Warnf("Multi search of %d failed, search singly: %s", len(batch), err)
+
+		for _, req := range batch {
+			go m.single(req)
+		}
+
+		return
+	}
+
+	for i, req := range batch {
+		r := responses[i]
+
+		if e, ok := r["error"]; ok {
+			status, _ := r["status"].(float64)
+
+			if status == 429 || status >= 500 {
+				sugar.Warnf("Search %s failed in batch, retry singly: %v", req.key, e)
+				go m.single(req)
+			} else {
+				req.reply <- msearchReply{
+					err: fmt.Errorf("search %s failed: %v", req.key, e),
+				}
+			}
+		} else {
+			req.reply <- msearchReply{
+				r: r,
+			}
+		}
+	}
+}
+
+func (m *multiSearcher) msearch(batch []*msearchRequest) ([]map[string]interface{}, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	for _, req := range batch {
+		// The size goes in the body, as there's no per-search parameter for it.
+		body := map[string]interface{}{
+			"size": req.size,
+		}
+
+		for k, v := range req.query {
+			body[k] = v
+		}
+
+		if err := enc.Encode(map[string]interface{}{}); err != nil {
+			return nil, err
+		}
+
+		if err := enc.Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	es := m.c.client
+	ctx, cancel := batchContext(batch)
+	defer cancel()
+
+	if m.c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.c.timeout)
+		defer cancel()
+	}
+
+	res, err := es.Msearch(&buf,
+		es.Msearch.WithContext(ctx),
+		es.Msearch.WithIndex(m.c.index),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("[%s]", res.Status())
+	}
+
+	var r struct {
+		Responses []map[string]interface{} `json:"responses"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	if len(r.Responses) != len(batch) {
+		return nil, fmt.Errorf("got %d responses for %d searches", len(r.Responses), len(batch))
+	}
+
+	return r.Responses, nil
+}
+
+// A context for a batch, which is cancelled once every caller in it has given up, as then nobody wants the answer.
+func batchContext(batch []*msearchRequest) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for _, req := range batch {
+			select {
+			case <-req.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		cancel()
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Orientation is which way the text in a fragment reads.  Rotation is clockwise from ordinary left to right text, so
+// an English spine, read top to bottom, is 90 and a continental one, read bottom to top, is 270.  Skew is how far off
+// that the text is, in degrees clockwise, from a tilted photo or a leaning book.
+type Orientation struct {
+	Rotation int     `json:"rotation"`
+	Skew     float64 `json:"skew"`
+}
+
+// The direction the text runs in, as a unit vector.  Google gives the vertices in reading order - top left, top
+// right, bottom right, bottom left of the text as it reads - so that's the first edge.
+func textDirection(poly BoundingPoly) (float64, float64, bool) {
+	v := poly.corners()
+
+	if v == nil {
+		return 0, 0, false
+	}
+
+	dx := float64(v[1].X - v[0].X)
+	dy := float64(v[1].Y - v[0].Y)
+
+	if dx == 0 && dy == 0 {
+		// A single letter might have no length; fall back to the bottom edge.
+		dx = float64(v[2].X - v[3].X)
+		dy = float64(v[2].Y - v[3].Y)
+	}
+
+	length := math.Hypot(dx, dy)
+
+	if length == 0 {
+		return 0, 0, false
+	}
+
+	return dx / length, dy / length, true
+}
+
+// Image y runs down, so angles from atan2 are already clockwise.
+func orientationOf(dx float64, dy float64) Orientation {
+	angle := math.Atan2(dy, dx) * 180 / math.Pi
+	quarters := int(math.Floor(angle/90 + 0.5))
+
+	return Orientation{
+		Rotation: ((quarters*90)%360 + 360) % 360,
+		Skew:     angle - float64(quarters*90),
+	}
+}
+
+// FragmentOrientation works out which way a fragment reads from its bounding polygon.
+func FragmentOrientation(poly BoundingPoly) (Orientation, bool) {
+	dx, dy, ok := textDirection(poly)
+
+	if !ok {
+		return Orientation{}, false
+	}
+
+	return orientationOf(dx, dy), true
+}
+
+// Put the words on a spine into reading order.  They read along the text, but a wide spine can have more than one
+// line of text, usually the author and the title side by side, so first we find the lines and take them top one first
+// - top as the text reads, which for a spine read top to bottom is the right hand side.
+func readingOrder(placed []placedFragment) []placedFragment {
+	if len(placed) < 2 {
+		return placed
+	}
+
+	dx, dy := segmentDirection(placed)
+	norm := math.Hypot(dx, dy)
+
+	if norm == 0 {
+		return placed
+	}
+
+	dx, dy = dx/norm, dy/norm
+
+	// Down the page as the text reads, which is the direction turned a quarter clockwise.
+	downx, downy := -dy, dx
+
+	type word struct {
+		p      placedFragment
+		along  float64
+		across float64
+		line   int
+	}
+
+	words := []*word{}
+
+	for _, p := range placed {
+		words = append(words, &word{
+			p:      p,
+			along:  p.x*dx + p.y*dy,
+			across: p.x*downx + p.y*downy,
+		})
+	}
+
+	sort.SliceStable(words, func(i, j int) bool {
+		return words[i].across < words[j].across
+	})
+
+	for n := 1; n < len(words); n++ {
+		words[n].line = words[n-1].line
+
+		if words[n].across-words[n-1].across > SEGMENT_GAP*math.Max(words[n].p.height, words[n-1].p.height) {
+			words[n].line++
+		}
+	}
+
+	sort.SliceStable(words, func(i, j int) bool {
+		if words[i].line != words[j].line {
+			return words[i].line < words[j].line
+		}
+
+		return words[i].along < words[j].along
+	})
+
+	ordered := make([]placedFragment, len(words))
+
+	for n, w := range words {
+		ordered[n] = w.p
+	}
+
+	return ordered
+}
+
+// Put the words in a line into reading order.  A line from Google can run across several spines, so we order the words
+// within each run of text and keep the runs in the order they came.  Words we can't place stay after the word they
+// followed.
+func orderWords(fragments []OCRFragment) []OCRFragment {
+	placed := []placedFragment{}
+	after := map[int][]OCRFragment{} // Keyed on the placed word before, or -1 if there isn't one
+
+	for _, fragment := range fragments {
+		if p, ok := placeFragment(fragment); ok {
+			p.order = len(placed)
+			placed = append(placed, p)
+		} else {
+			after[len(placed)-1] = append(after[len(placed)-1], fragment)
+		}
+	}
+
+	ordered := append([]OCRFragment{}, after[-1]...)
+
+	for _, group := range linkFragments(placed) {
+		for _, p := range readingOrder(group) {
+			ordered = append(ordered, p.fragment)
+			ordered = append(ordered, after[p.order]...)
+		}
+	}
+
+	return ordered
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// A word on a spine reading bottom to top, as continental spines do, starting at x, y.
+func risingWord(word string, x int, y int) OCRFragment {
+	length := 15 * len(word)
+
+	return OCRFragment{
+		Description: word,
+		BoundingPoly: BoundingPoly{Vertices: []Vertices{
+			{X: x - 10, Y: y},
+			{X: x - 10, Y: y - length},
+			{X: x + 10, Y: y - length},
+			{X: x + 10, Y: y},
+		}},
+	}
+}
+
+func descriptions(fragments []OCRFragment) []string {
+	ret := []string{}
+
+	for _, fragment := range fragments {
+		ret = append(ret, fragment.Description)
+	}
+
+	return ret
+}
+
+func TestOrientation(t *testing.T) {
+	for _, test := range []struct {
+		fragment OCRFragment
+		rotation int
+	}{
+		{horizontalWord("FLAT", 100, 100), 0},
+		{verticalWord("DOWN", 100, 100), 90},
+		{risingWord("UP", 100, 100), 270},
+		{OCRFragment{BoundingPoly: BoundingPoly{Vertices: []Vertices{{X: 100, Y: 110}, {X: 40, Y: 110}, {X: 40, Y: 90}, {X: 100, Y: 90}}}}, 180},
+	} {
+		o, ok := FragmentOrientation(test.fragment.BoundingPoly)
+		assert.True(t, ok)
+		assert.Equal(t, test.rotation, o.Rotation)
+		assert.InDelta(t, 0, o.Skew, 0.001)
+	}
+
+	// A spine leaning a little, either way.
+	o, ok := FragmentOrientation(BoundingPoly{Vertices: []Vertices{{X: 100, Y: 0}, {X: 110, Y: 100}, {X: 90, Y: 100}, {X: 80, Y: 0}}})
+	assert.True(t, ok)
+	assert.Equal(t, 90, o.Rotation)
+	assert.InDelta(t, -5.71, o.Skew, 0.01)
+
+	o, _ = FragmentOrientation(BoundingPoly{Vertices: []Vertices{{X: 100, Y: 100}, {X: 90, Y: 0}, {X: 110, Y: 0}, {X: 120, Y: 100}}})
+	assert.Equal(t, 270, o.Rotation)
+	assert.InDelta(t, -5.71, o.Skew, 0.01)
+
+	// Nothing to go on.
+	_, ok = FragmentOrientation(BoundingPoly{Vertices: []Vertices{{X: 1, Y: 1}}})
+	assert.False(t, ok)
+	_, ok = FragmentOrientation(BoundingPoly{Vertices: make([]Vertices, 4)})
+	assert.False(t, ok)
+
+	lines, fragments := GetLinesAndFragments(`[{"description": "DOWN"}, {"description": "DOWN", "boundingPoly": {"vertices": [{"x": 110}, {"x": 110, "y": 60}, {"x": 90, "y": 60}, {"x": 90}]}}]`)
+	assert.Equal(t, []string{"DOWN"}, lines)
+	assert.Equal(t, 90, fragments[0].Orientation.Rotation)
+}
+
+func TestReadingOrder(t *testing.T) {
+	// Top to bottom and bottom to top spines, with the words out of order as the OCR sometimes gives them, and a word
+	// with no position which stays where it was.
+	assert.Equal(t, []string{"STEPHEN", "KING", "?"}, descriptions(orderWords([]OCRFragment{
+		verticalWord("KING", 100, 140),
+		{Description: "?"},
+		verticalWord("STEPHEN", 100, 20),
+	})))
+
+	assert.Equal(t, []string{"STEPHEN", "KING", "DARK", "TOWER"}, descriptions(orderWords([]OCRFragment{
+		verticalWord("KING", 100, 140),
+		verticalWord("STEPHEN", 100, 20),
+		risingWord("TOWER", 200, 80),
+		risingWord("DARK", 200, 160),
+	})))
+
+	// A wide spine with the author and title side by side.  The top line as the text reads is on the right.
+	placed := []placedFragment{}
+
+	for _, fragment := range []OCRFragment{
+		verticalWord("TOWER", 100, 90),
+		verticalWord("KING", 130, 90),
+		verticalWord("DARK", 100, 20),
+		verticalWord("STEPHEN", 130, 0),
+	} {
+		p, ok := placeFragment(fragment)
+		assert.True(t, ok)
+		placed = append(placed, p)
+	}
+
+	words := []string{}
+
+	for _, p := range readingOrder(placed) {
+		words = append(words, p.fragment.Description)
+	}
+
+	assert.Equal(t, []string{"STEPHEN", "KING", "DARK", "TOWER"}, words)
+
+	// And the same read the other way up.
+	placed = []placedFragment{}
+
+	for _, fragment := range []OCRFragment{
+		risingWord("TOWER", 130, 80),
+		risingWord("KING", 100, 80),
+		risingWord("DARK", 130, 160),
+		risingWord("STEPHEN", 100, 200),
+	} {
+		p, _ := placeFragment(fragment)
+		placed = append(placed, p)
+	}
+
+	words = []string{}
+
+	for _, p := range readingOrder(placed) {
+		words = append(words, p.fragment.Description)
+	}
+
+	assert.Equal(t, []string{"STEPHEN", "KING", "DARK", "TOWER"}, words)
+
+	// Lines put right when we shelve them.
+	lines, _ := ShelveLines([]string{"KING STEPHEN"}, []OCRFragment{verticalWord("KING", 100, 140), verticalWord("STEPHEN", 100, 20)})
+	assert.Equal(t, []string{"STEPHEN KING"}, lines)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// The default for how many searches we run at once.  Each one is a request to the catalogue, so without a limit a
+// big shelf would fire off hundreds at the same time.
+const SEARCH_CONCURRENCY = 32
+
+type searchEntry struct {
+	phaseid    int
+	spineindex int
+	author     string
+	title      string
+	wordindex  int
+}
+
+// We're playing a balancing game - if we find a result early then we can save on other searches.  So we don't
+// want to do all searches for the same spine simultaneously.  Ordering by word index means we are less likely to.
+func searchBefore(a, b searchEntry) bool {
+	if a.wordindex != b.wordindex {
+		return a.wordindex > b.wordindex
+	}
+
+	return a.spineindex > b.spineindex
+}
+
+type searchHeap []searchEntry
+
+func (h searchHeap) Len() int           { return len(h) }
+func (h searchHeap) Less(i, j int) bool { return searchBefore(h[i], h[j]) }
+func (h searchHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *searchHeap) Push(x interface{}) {
+	*h = append(*h, x.(searchEntry))
+}
+
+func (h *searchHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// The searches waiting for a worker, best first.
+type searchQueue struct {
+	mux     sync.Mutex
+	entries searchHeap
+}
+
+func newSearchQueue(searches []searchEntry) *searchQueue {
+	q := &searchQueue{
+		entries: append(searchHeap{}, searches...),
+	}
+
+	heap.Init(&q.entries)
+
+	return q
+}
+
+func (q *searchQueue) len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return len(q.entries)
+}
+
+func (q *searchQueue) pop() (searchEntry, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.entries) == 0 {
+		return searchEntry{}, false
+	}
+
+	return heap.Pop(&q.entries).(searchEntry), true
+}
+
+// Once a spine is identified there's no point running the rest of its searches, so remove them.
+func (q *searchQueue) drop(spineindex int) int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	kept := q.entries[:0]
+
+	for _, entry := range q.entries {
+		if entry.spineindex != spineindex {
+			kept = append(kept, entry)
+		}
+	}
+
+	dropped := len(q.entries) - len(kept)
+	q.entries = kept
+	heap.Init(&q.entries)
+
+	return dropped
+}
+
+// Run the queued searches on a bounded number of workers, and wait for them all to finish.
+func (q *searchQueue) run(workers int, fn func(searchEntry)) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if workers > q.len() {
+		workers = q.len()
+	}
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for s, ok := q.pop(); ok; s, ok = q.pop() {
+				fn(s)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestSearchQueue(t *testing.T) {
+	q := newSearchQueue([]searchEntry{
+		{spineindex: 0, wordindex: 0},
+		{spineindex: 1, wordindex: 2},
+		{spineindex: 0, wordindex: 2},
+		{spineindex: 1, wordindex: 1},
+		{spineindex: 2, wordindex: 0},
+	})
+
+	// Longest split first, then highest spine.
+	s, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, searchEntry{spineindex: 1, wordindex: 2}, s)
+
+	assert.Equal(t, 1, q.drop(1))
+	assert.Equal(t, 3, q.len())
+
+	s, _ = q.pop()
+	assert.Equal(t, searchEntry{spineindex: 0, wordindex: 2}, s)
+	s, _ = q.pop()
+	assert.Equal(t, searchEntry{spineindex: 2, wordindex: 0}, s)
+	s, _ = q.pop()
+	assert.Equal(t, searchEntry{spineindex: 0, wordindex: 0}, s)
+	_, ok = q.pop()
+	assert.False(t, ok)
+}
+
+func TestSearchQueueRun(t *testing.T) {
+	searches := []searchEntry{}
+
+	for i := 0; i < 100; i++ {
+		searches = append(searches, searchEntry{spineindex: i % 10, wordindex: i / 10})
+	}
+
+	var mux sync.Mutex
+	running := 0
+	most := 0
+	done := 0
+
+	q := newSearchQueue(searches)
+	q.run(4, func(s searchEntry) {
+		mux.Lock()
+		running++
+
+		if running > most {
+			most = running
+		}
+
+		mux.Unlock()
+
+		// Identifying spine 3 stops the rest of its searches.
+		if s.spineindex == 3 {
+			q.drop(3)
+		}
+
+		mux.Lock()
+		running--
+		done++
+		mux.Unlock()
+	})
+
+	assert.True(t, most <= 4)
+	assert.True(t, done < 100)
+}
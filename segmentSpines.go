@@ -0,0 +1,255 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// How far apart, across the direction of the text, two words can be and still be on the same spine.  This is a
+// fraction of the height of the taller one - words in the same run of text line up to well within their height,
+// whereas the next spine along is usually at least a letter height away.
+const SEGMENT_GAP = 0.6
+
+// How far apart two words can be along the text, in letter heights, and still be on the same spine.  Words further
+// apart than that which happen to line up are probably on different books.
+const SEGMENT_ALONG_GAP = 6
+
+// How different, in degrees, the direction of two words can be.  Photos of a shelf fan out, so spines at either side
+// lean differently, but the words on one spine are close to parallel.
+const SEGMENT_ANGLE = 20
+
+// How we split the OCR into spines.
+const (
+	SEGMENT_LINES    = "lines"    // Trust the newlines in the summary
+	SEGMENT_GEOMETRY = "geometry" // Cluster the fragments by where they are in the image
+)
+
+// The shape of a fragment.
+type placedFragment struct {
+	fragment OCRFragment
+	dx       float64 // Unit vector in the direction of the text
+	dy       float64
+	length   float64 // Along the text
+	height   float64 // Letter height
+	x        float64 // Centre in the image
+	y        float64
+	order    int // Where it was before we sorted
+}
+
+// Which way the text runs, in quarter turns clockwise from left to right.
+func (p placedFragment) class() int {
+	return orientationOf(p.dx, p.dy).Rotation / 90
+}
+
+// Whether two words are part of the same run of text - they point the same way, line up, and are close.
+func (p placedFragment) sameSpine(q placedFragment) bool {
+	if p.fragment.Block > 0 && q.fragment.Block > 0 && p.fragment.Block != q.fragment.Block {
+		// Google put them in different blocks, which it rarely does with the words on one spine.
+		return false
+	}
+
+	if p.dx*q.dx+p.dy*q.dy < math.Cos(SEGMENT_ANGLE*math.Pi/180) {
+		return false
+	}
+
+	// Measure in the average of their directions.
+	dx, dy := p.dx+q.dx, p.dy+q.dy
+	norm := math.Hypot(dx, dy)
+	dx, dy = dx/norm, dy/norm
+
+	ox, oy := q.x-p.x, q.y-p.y
+	across := math.Abs(-ox*dy + oy*dx)
+	along := math.Abs(ox*dx+oy*dy) - (p.length+q.length)/2
+	height := math.Max(p.height, q.height)
+
+	// A word Google wasn't sure of might not be text at all, so it has to be closer to count.
+	height *= math.Min(p.certainty(), q.certainty())
+
+	return across <= SEGMENT_GAP*height && along <= SEGMENT_ALONG_GAP*height
+}
+
+// How much we trust a word to link spines together, from 0 to 1.  If Google didn't say, we trust it.
+func (p placedFragment) certainty() float64 {
+	c := p.fragment.Confidence
+
+	if c == 0 || c >= OCR_SURE_CONFIDENCE {
+		return 1
+	}
+
+	return c / OCR_SURE_CONFIDENCE
+}
+
+// The summary in the OCR is Google's idea of lines of text, which often breaks a spine in two or runs two together,
+// and so much of identifyBooks is about healing that.  Instead we can use where the words are.  The words on a spine
+// run in the same direction and share a long axis; the spines next to it are separate columns with a gap between.
+//
+// This returns lines and fragments in the same form as GetLinesAndFragments, so they can go through ExtractSpines in
+// the usual way.
+func SegmentSpines(fragments []OCRFragment) ([]string, []OCRFragment) {
+	placed := []placedFragment{}
+
+	for _, fragment := range fragments {
+		if p, ok := placeFragment(fragment); ok {
+			placed = append(placed, p)
+		} else {
+			sugar.Debugf("No geometry for %s, ignore", fragment.Description)
+		}
+	}
+
+	segments := [][]placedFragment{}
+
+	for _, group := range linkFragments(placed) {
+		segments = append(segments, readingOrder(group))
+	}
+
+	sortSegments(segments)
+
+	lines := []string{}
+	ordered := []OCRFragment{}
+
+	for _, segment := range segments {
+		words := []string{}
+
+		for _, p := range segment {
+			words = append(words, p.fragment.Description)
+			fragment := p.fragment
+			fragment.SpineIndex = len(lines)
+			ordered = append(ordered, fragment)
+		}
+
+		lines = append(lines, strings.Join(words, " "))
+	}
+
+	sugar.Debugf("Segmented %d fragments into %d spines", len(ordered), len(lines))
+
+	return lines, ordered
+}
+
+func placeFragment(fragment OCRFragment) (placedFragment, bool) {
+	poly := fragment.BoundingPoly
+	dx, dy, ok := textDirection(poly)
+
+	if !ok {
+		return placedFragment{}, false
+	}
+
+	x, y := poly.Centroid()
+
+	return placedFragment{
+		fragment: fragment,
+		dx:       dx,
+		dy:       dy,
+		length:   poly.Width(),
+		height:   math.Max(1, poly.Height()),
+		x:        x,
+		y:        y,
+	}, true
+}
+
+// Group the fragments which are linked by being on the same spine, directly or through other words.  The groups
+// keep the order of the fragments.
+func linkFragments(placed []placedFragment) [][]placedFragment {
+	parent := make([]int, len(placed))
+
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+
+		return parent[i]
+	}
+
+	for a := 0; a < len(placed); a++ {
+		for b := a + 1; b < len(placed); b++ {
+			if placed[a].sameSpine(placed[b]) {
+				parent[find(a)] = find(b)
+			}
+		}
+	}
+
+	groups := [][]placedFragment{}
+	index := map[int]int{}
+
+	for i, p := range placed {
+		root := find(i)
+
+		if _, ok := index[root]; !ok {
+			index[root] = len(groups)
+			groups = append(groups, []placedFragment{})
+		}
+
+		groups[index[root]] = append(groups[index[root]], p)
+	}
+
+	return groups
+}
+
+func segmentDirection(segment []placedFragment) (float64, float64) {
+	var dx, dy float64
+
+	for _, p := range segment {
+		dx += p.dx
+		dy += p.dy
+	}
+
+	return dx, dy
+}
+
+// Books standing on a shelf go left to right.  Books in a pile have horizontal text and go top to bottom as we read
+// them, which is bottom to top of the image if the photo is upside down.
+func segmentPosition(segment []placedFragment) (bool, float64) {
+	dx, dy := segmentDirection(segment)
+	var x, y float64
+
+	for _, p := range segment {
+		x += p.x / float64(len(segment))
+		y += p.y / float64(len(segment))
+	}
+
+	switch (placedFragment{dx: dx, dy: dy}).class() {
+	case 0:
+		return true, y
+	case 2:
+		return true, -y
+	}
+
+	return false, x
+}
+
+// Standing books first, then piles.
+func positionBefore(horizontal1 bool, across1 float64, horizontal2 bool, across2 float64) bool {
+	if horizontal1 != horizontal2 {
+		return !horizontal1
+	}
+
+	return across1 < across2
+}
+
+func sortSegments(segments [][]placedFragment) {
+	type position struct {
+		segment    []placedFragment
+		horizontal bool
+		across     float64
+	}
+
+	positions := []position{}
+
+	for _, segment := range segments {
+		horizontal, across := segmentPosition(segment)
+		positions = append(positions, position{segment, horizontal, across})
+	}
+
+	sort.SliceStable(positions, func(i, j int) bool {
+		return positionBefore(positions[i].horizontal, positions[i].across, positions[j].horizontal, positions[j].across)
+	})
+
+	for i, p := range positions {
+		segments[i] = p.segment
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+// A word on a spine reading top to bottom, as English spines do, starting at x, y.
+func verticalWord(word string, x int, y int) OCRFragment {
+	length := 15 * len(word)
+
+	return OCRFragment{
+		Description: word,
+		BoundingPoly: BoundingPoly{Vertices: []Vertices{
+			{X: x + 10, Y: y},
+			{X: x + 10, Y: y + length},
+			{X: x - 10, Y: y + length},
+			{X: x - 10, Y: y},
+		}},
+	}
+}
+
+// A word on a book lying flat.
+func horizontalWord(word string, x int, y int) OCRFragment {
+	length := 15 * len(word)
+
+	return OCRFragment{
+		Description: word,
+		BoundingPoly: BoundingPoly{Vertices: []Vertices{
+			{X: x, Y: y - 10},
+			{X: x + length, Y: y - 10},
+			{X: x + length, Y: y + 10},
+			{X: x, Y: y + 10},
+		}},
+	}
+}
+
+func TestSegmentSpines(t *testing.T) {
+	// Out of order, as the OCR might give them, with a pile of two books to the right of the shelf.
+	lines, fragments := SegmentSpines([]OCRFragment{
+		verticalWord("TOWER", 200, 90),
+		verticalWord("KING", 100, 140),
+		horizontalWord("VINTAGE", 400, 300),
+		verticalWord("STEPHEN", 100, 20),
+		horizontalWord("BLACK", 400, 200),
+		horizontalWord("PRINCE", 490, 200),
+		verticalWord("DARK", 200, 20),
+		{Description: "NOWHERE"},
+	})
+
+	assert.Equal(t, []string{"STEPHEN KING", "DARK TOWER", "BLACK PRINCE", "VINTAGE"}, lines)
+	assert.Equal(t, 7, len(fragments))
+	assert.Equal(t, "KING", fragments[1].Description)
+	assert.Equal(t, 0, fragments[1].SpineIndex)
+	assert.Equal(t, 3, fragments[6].SpineIndex)
+
+	// And they go through the usual pipeline.
+	spines, _ := ExtractSpines(lines, fragments)
+	assert.Equal(t, "STEPHEN KING", spines[0].Spine)
+}
+
+func TestSegmentSample(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/basic_horizontal.json")
+	assert.Nil(t, err)
+	lines, fragments := GetLinesAndFragments(string(data))
+	segmented, segfragments := SegmentSpines(fragments)
+
+	// The same lines as Google found, though the author and title on one book can come either way round.
+	assert.ElementsMatch(t, lines[0:len(lines)-1], segmented)
+	assert.Equal(t, len(fragments), len(segfragments))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// The most space, in letter heights, between the text on one shelf and the next for them to count as one.  Shelves
+// are separated by the board and the tops of the books, so there's usually a good gap.
+const SHELF_GAP = 1.0
+
+// Bands with fewer words than this are stray text - a label on the edge of the shelf, say - rather than a shelf.
+const SHELF_MIN_FRAGMENTS = 3
+
+// A band of the image holding the text from one shelf.
+type shelfBand struct {
+	start   float64
+	end     float64
+	members []int
+}
+
+// AssignShelves works out which shelf each fragment is on.  Books standing on a shelf have text running up and down
+// the spines, and each shelf is a horizontal band of that text with a gap above and below it.  If most of the text
+// runs across the photo then it's been taken on its side, and the bands are vertical instead.
+//
+// Fragments we can't place stay with the shelf of the one before, which is usually the next word along.
+func AssignShelves(fragments []OCRFragment) []OCRFragment {
+	type interval struct {
+		index int
+		start float64
+		end   float64
+	}
+
+	placed := map[int]placedFragment{}
+	vertical := 0
+	heights := []float64{}
+
+	for index, fragment := range fragments {
+		if p, ok := placeFragment(fragment); ok {
+			placed[index] = p
+
+			if p.class()%2 == 1 {
+				vertical++
+			}
+
+			heights = append(heights, p.height)
+		}
+	}
+
+	if len(placed) == 0 {
+		return fragments
+	}
+
+	standing := vertical*2 >= len(placed)
+	intervals := []interval{}
+
+	for index := range placed {
+		left, top, right, bottom := fragments[index].BoundingPoly.Box()
+
+		if standing {
+			intervals = append(intervals, interval{index, float64(top), float64(bottom)})
+		} else {
+			intervals = append(intervals, interval{index, float64(left), float64(right)})
+		}
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		if intervals[i].start != intervals[j].start {
+			return intervals[i].start < intervals[j].start
+		}
+
+		return intervals[i].index < intervals[j].index
+	})
+
+	sort.Float64s(heights)
+	gap := SHELF_GAP * heights[len(heights)/2]
+	bands := []*shelfBand{}
+
+	for _, iv := range intervals {
+		if len(bands) > 0 && iv.start <= bands[len(bands)-1].end+gap {
+			band := bands[len(bands)-1]
+			band.end = math.Max(band.end, iv.end)
+			band.members = append(band.members, iv.index)
+		} else {
+			bands = append(bands, &shelfBand{iv.start, iv.end, []int{iv.index}})
+		}
+	}
+
+	bands = foldSmallBands(bands)
+	sugar.Debugf("Found %d shelves", len(bands))
+
+	for shelf, band := range bands {
+		for _, index := range band.members {
+			fragments[index].Shelf = shelf
+		}
+	}
+
+	for index := range fragments {
+		if _, ok := placed[index]; !ok && index > 0 {
+			fragments[index].Shelf = fragments[index-1].Shelf
+		}
+	}
+
+	return fragments
+}
+
+// Put the words from bands too small to be a shelf onto the nearest real one.
+func foldSmallBands(bands []*shelfBand) []*shelfBand {
+	big := []*shelfBand{}
+
+	for _, band := range bands {
+		if len(band.members) >= SHELF_MIN_FRAGMENTS {
+			big = append(big, band)
+		}
+	}
+
+	if len(big) == 0 {
+		// No shelves to speak of - it's all one.
+		all := &shelfBand{bands[0].start, bands[len(bands)-1].end, []int{}}
+
+		for _, band := range bands {
+			all.members = append(all.members, band.members...)
+		}
+
+		return []*shelfBand{all}
+	}
+
+	for _, band := range bands {
+		if len(band.members) < SHELF_MIN_FRAGMENTS {
+			nearest := big[0]
+
+			for _, b := range big {
+				if bandDistance(band, b) < bandDistance(band, nearest) {
+					nearest = b
+				}
+			}
+
+			nearest.members = append(nearest.members, band.members...)
+		}
+	}
+
+	return big
+}
+
+func bandDistance(a *shelfBand, b *shelfBand) float64 {
+	return math.Max(0, math.Max(a.start-b.end, b.start-a.end))
+}
+
+// ShelveLines splits the lines so that no line crosses from one shelf to another, and puts them in order - shelf by
+// shelf, and left to right along each shelf.  Google's line order interleaves the spines from different shelves, and
+// then spines which look adjacent aren't really.  The fragments must have their shelves assigned, and are returned in
+// the same order as the new lines.
+func ShelveLines(lines []string, fragments []OCRFragment) ([]string, []OCRFragment) {
+	type piece struct {
+		shelf      int
+		fragments  []OCRFragment
+		horizontal bool
+		across     float64
+	}
+
+	pieces := []*piece{}
+	fragindex := 0
+
+	for _, line := range lines {
+		byshelf := map[int]*piece{}
+
+		for _, word := range strings.Split(line, " ") {
+			if len(word) == 0 || fragindex >= len(fragments) {
+				continue
+			}
+
+			fragment := fragments[fragindex]
+			fragindex++
+			p, ok := byshelf[fragment.Shelf]
+
+			if !ok {
+				p = &piece{shelf: fragment.Shelf}
+				byshelf[fragment.Shelf] = p
+				pieces = append(pieces, p)
+			}
+
+			p.fragments = append(p.fragments, fragment)
+		}
+	}
+
+	var last *piece
+
+	for _, p := range pieces {
+		// Google's lines don't always read the right way along a spine, but the geometry does.
+		p.fragments = orderWords(p.fragments)
+		segment := []placedFragment{}
+
+		for _, fragment := range p.fragments {
+			if pf, ok := placeFragment(fragment); ok {
+				segment = append(segment, pf)
+			}
+		}
+
+		if len(segment) > 0 {
+			p.horizontal, p.across = segmentPosition(segment)
+		} else if last != nil {
+			// Nowhere to put it, so keep it after the one before.
+			p.horizontal, p.across = last.horizontal, last.across
+		}
+
+		last = p
+	}
+
+	sort.SliceStable(pieces, func(i, j int) bool {
+		if pieces[i].shelf != pieces[j].shelf {
+			return pieces[i].shelf < pieces[j].shelf
+		}
+
+		return positionBefore(pieces[i].horizontal, pieces[i].across, pieces[j].horizontal, pieces[j].across)
+	})
+
+	newlines := []string{}
+	newfragments := []OCRFragment{}
+
+	for _, p := range pieces {
+		words := []string{}
+
+		for _, fragment := range p.fragments {
+			words = append(words, fragment.Description)
+			fragment.SpineIndex = len(newlines)
+			newfragments = append(newfragments, fragment)
+		}
+
+		newlines = append(newlines, strings.Join(words, " "))
+	}
+
+	return newlines, newfragments
+}
+
+// Number the spines along each shelf, left to right.  The spines must be in shelf order.
+func numberSpines(spines []Spine) []Spine {
+	position := 0
+
+	for spineindex := range spines {
+		if spineindex > 0 && spines[spineindex].Shelf != spines[spineindex-1].Shelf {
+			position = 0
+		}
+
+		spines[spineindex].Position = position
+		position++
+	}
+
+	return spines
+}
+
+// Whether two spines are on the same shelf, and so might really be next to each other.
+func sameShelf(spines []Spine, a int, b int) bool {
+	return spines[a].Shelf == spines[b].Shelf
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShelves(t *testing.T) {
+	// Two shelves, with Google's lines running across both.
+	lines, fragments := ShelveLines([]string{"STEPHEN KING IRIS MURDOCH", "DARK TOWER VINTAGE"}, AssignShelves([]OCRFragment{
+		verticalWord("STEPHEN", 100, 20),
+		verticalWord("KING", 100, 140),
+		verticalWord("IRIS", 150, 420),
+		verticalWord("MURDOCH", 150, 490),
+		verticalWord("DARK", 200, 20),
+		verticalWord("TOWER", 200, 90),
+		verticalWord("VINTAGE", 250, 420),
+	}))
+
+	assert.Equal(t, []string{"STEPHEN KING", "DARK TOWER", "IRIS MURDOCH", "VINTAGE"}, lines)
+	assert.Equal(t, 1, fragments[4].Shelf)
+
+	spines, _ := ExtractSpines(lines, fragments)
+	assert.Equal(t, 4, len(spines))
+	assert.Equal(t, []int{0, 0, 1, 1}, []int{spines[0].Shelf, spines[1].Shelf, spines[2].Shelf, spines[3].Shelf})
+	assert.Equal(t, []int{0, 1, 0, 1}, []int{spines[0].Position, spines[1].Position, spines[2].Position, spines[3].Position})
+}
+
+func TestShelfAdjacency(t *testing.T) {
+	c := &exactCatalogue{stubCatalogue{works: []Work{
+		{Author: "Edward Marston", Title: "Dance of Death", NormalAuthor: "edward marston", NormalTitle: "dance death", VIAF: "1"},
+		{Author: "Stephen King", Title: "The Dark Tower", NormalAuthor: "stephen king", NormalTitle: "dark tower", VIAF: "2"},
+	}}}
+
+	// The end of one shelf and the start of the next aren't the same book.
+	spines, _, err := NewIdentifier(c).IdentifyBooks(context.Background(), []Spine{
+		{Spine: "EDWARD MARSTON DANCE OF DEATH"},
+		{Spine: "STEPHEN KING"},
+		{Spine: "DARK TOWER", Shelf: 1},
+	}, []OCRFragment{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(spines))
+	assert.Equal(t, "", spines[1].Author)
+	assert.Equal(t, 0, spines[2].Position)
+}